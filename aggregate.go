@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"time"
+)
+
+var aggregateFields []string
+
+// aggregate is the events of a request that share a sampling key, merged into
+// the first of them. The aggregated numeric fields are replaced by their
+// min, max, sum and count across the merged events.
+type aggregate struct {
+	data      map[string]interface{}
+	timestamp time.Time
+	stats     map[string]*fieldStats
+}
+
+type fieldStats struct {
+	min, max, sum float64
+	count         int
+}
+
+// aggregate merges an event into the aggregate for its sampling key, taking
+// ownership of data.
+func (in *ingest) aggregate(data map[string]interface{}, timestamp time.Time) {
+
+	key := samplingKey(data, in.headerKeys)
+	agg, merged := in.aggregates[key]
+	if !merged {
+		if in.aggregates == nil {
+			in.aggregates = make(map[string]*aggregate)
+		}
+		agg = &aggregate{data: data, timestamp: timestamp, stats: make(map[string]*fieldStats)}
+		in.aggregates[key] = agg
+		in.aggregateOrder = append(in.aggregateOrder, key)
+	}
+
+	for _, field := range aggregateFields {
+		f, ok := numericValue(data[field])
+		if !ok {
+			continue
+		}
+		st, ok := agg.stats[field]
+		switch {
+		case !ok:
+			agg.stats[field] = &fieldStats{min: f, max: f, sum: f, count: 1}
+		default:
+			if f < st.min {
+				st.min = f
+			}
+			if f > st.max {
+				st.max = f
+			}
+			st.sum += f
+			st.count++
+		}
+		if !merged {
+			delete(data, field)
+		}
+	}
+
+	if merged {
+		putEventMap(data)
+	}
+}
+
+// flushAggregates samples and sends the merged event for each sampling key
+// seen in the request, in the order the keys were first seen.
+func (in *ingest) flushAggregates() {
+
+	for _, key := range in.aggregateOrder {
+		agg := in.aggregates[key]
+		for field, st := range agg.stats {
+			agg.data[fieldName(field+".min")] = st.min
+			agg.data[fieldName(field+".max")] = st.max
+			agg.data[fieldName(field+".sum")] = st.sum
+			agg.data[fieldName(field+".count")] = st.count
+		}
+		if err := in.sample(agg.data, agg.timestamp, nil); err != nil {
+			in.logf("%v\n", err)
+		}
+	}
+	in.aggregates = nil
+	in.aggregateOrder = nil
+}
+
+// numericValue returns the value of a numeric field as a float64.
+func numericValue(val interface{}) (float64, bool) {
+
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditMask replaces sensitive values in the audit log.
+const AuditMask = "***"
+
+// configAudit records configuration changes when CONFIG_AUDIT_LOG_FILE is set.
+var configAudit *auditLog
+
+// auditSensitiveKeys are substrings of configuration keys whose values are
+// never written to the audit log.
+var auditSensitiveKeys = []string{"api_key", "ingest_token"}
+
+// auditLog appends a JSON line to a file for every reload that changes the
+// configuration. The file is never rotated or truncated by honeylog.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+type auditEntry struct {
+	Timestamp   time.Time              `json:"timestamp"`
+	Trigger     string                 `json:"trigger"`
+	ChangedKeys []string               `json:"changed_keys"`
+	OldValues   map[string]interface{} `json:"old_values"`
+	NewValues   map[string]interface{} `json:"new_values"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f}, nil
+}
+
+// record compares two snapshots of configuration keys and values, and logs
+// the keys that were added, removed or changed by a reload. Nothing is
+// logged if nothing changed, or if auditing is off.
+func (a *auditLog) record(trigger string, before, after map[string]interface{}) {
+
+	if a == nil {
+		return
+	}
+
+	entry := auditEntry{
+		Timestamp:   time.Now().UTC(),
+		Trigger:     trigger,
+		ChangedKeys: []string{},
+		OldValues:   map[string]interface{}{},
+		NewValues:   map[string]interface{}{},
+	}
+	keys := make(map[string]bool, len(before)+len(after))
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	for k := range keys {
+		oldValue, hadOld := before[k]
+		newValue, hasNew := after[k]
+		if hadOld == hasNew && auditEqual(oldValue, newValue) {
+			continue
+		}
+		entry.ChangedKeys = append(entry.ChangedKeys, k)
+		if hadOld {
+			entry.OldValues[k] = auditValue(k, oldValue)
+		}
+		if hasNew {
+			entry.NewValues[k] = auditValue(k, newValue)
+		}
+	}
+	if len(entry.ChangedKeys) == 0 {
+		return
+	}
+	sort.Strings(entry.ChangedKeys)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("error writing config audit log: %v\n", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		fmt.Printf("error writing config audit log: %v\n", err)
+	}
+}
+
+func auditEqual(a, b interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+func auditValue(key string, value interface{}) interface{} {
+	lower := strings.ToLower(key)
+	for _, sensitive := range auditSensitiveKeys {
+		if strings.Contains(lower, sensitive) {
+			return AuditMask
+		}
+	}
+	return value
+}
+
+// overrideAuditValues snapshots sampling overrides for the audit log, keyed
+// by prefix and override key so each override is tracked on its own.
+func overrideAuditValues(prefix string, overrides []samplingOverride) map[string]interface{} {
+	values := make(map[string]interface{}, len(overrides))
+	for _, o := range overrides {
+		values[prefix+o.Key] = o
+	}
+	return values
+}
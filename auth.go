@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"path"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AdminPathPrefix marks administrative endpoints, which always require
+// authentication.
+const AdminPathPrefix = "/admin/"
+
+var authFailures = metrics.Counter("honeylog_auth_failures_total", "Requests rejected for a missing or wrong ingest token.")
+
+// requireIngestToken wraps a handler so requests must carry token as a bearer
+// token in their Authorization header. Requests for bypass paths, such as
+// health checks from shippers that can't send headers, skip the check. A
+// bypass path ending in * covers every path it prefixes. Paths under
+// AdminPathPrefix are never bypassed.
+func requireIngestToken(next http.Handler, token string, bypass []string) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authBypassed(r.URL.Path, bypass) || validBearerToken(r.Header.Get("Authorization"), token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		authFailures.Inc()
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, ErrorAuthFailed, "a valid ingest token is required")
+	})
+}
+
+// requireIngestTokenStream is requireIngestToken for gRPC streams, which must
+// carry the token in their authorization metadata. Streams are never
+// bypassed, and are refused with Unauthenticated.
+func requireIngestTokenStream(token string) grpc.StreamServerInterceptor {
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		for _, v := range md.Get("authorization") {
+			if validBearerToken(v, token) {
+				return handler(srv, ss)
+			}
+		}
+		authFailures.Inc()
+		return status.Error(codes.Unauthenticated, "a valid ingest token is required")
+	}
+}
+
+func authBypassed(requestPath string, bypass []string) bool {
+
+	p := path.Clean("/" + requestPath)
+	if strings.HasPrefix(p+"/", AdminPathPrefix) {
+		return false
+	}
+	for _, b := range bypass {
+		if prefix := strings.TrimSuffix(b, "*"); prefix != b {
+			if strings.HasPrefix(p, prefix) {
+				return true
+			}
+		} else if p == b {
+			return true
+		}
+	}
+	return false
+}
+
+func validBearerToken(header, token string) bool {
+
+	scheme, value, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(value)), []byte(token)) == 1
+}
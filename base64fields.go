@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+var base64Fields []string
+
+// base64Encodings are tried in order when decoding a BASE64_DECODE_FIELDS
+// value, since emitters differ in alphabet and padding.
+var base64Encodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
+// decodeBase64Fields decodes the values of base64Fields. A value that decodes
+// to a JSON object is broken out into fields named after the field with a
+// "." and each key; anything else replaces the value as a plain string. A
+// value that isn't base64 is left as it is.
+func decodeBase64Fields(data map[string]interface{}) error {
+
+	for _, f := range base64Fields {
+		s, ok := data[f].(string)
+		if !ok {
+			continue
+		}
+		decoded, err := decodeBase64(s)
+		if err != nil {
+			fmt.Printf("warning: field %s is not base64, keeping it as is: %v\n", f, err)
+			continue
+		}
+
+		var nested map[string]interface{}
+		if err := json.Unmarshal(decoded, &nested); err != nil || nested == nil {
+			data[f] = string(decoded)
+			continue
+		}
+		delete(data, f)
+		if err := injectNested(data, f+".", nested); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeBase64 decodes s with the first of base64Encodings that accepts it,
+// returning the standard encoding's error if none do.
+func decodeBase64(s string) ([]byte, error) {
+
+	var firstErr error
+	for _, enc := range base64Encodings {
+		b, err := enc.DecodeString(s)
+		if err == nil {
+			return b, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// injectNested adds the values of nested to data under prefix, descending
+// into nested objects so their keys are joined with ".".
+func injectNested(data map[string]interface{}, prefix string, nested map[string]interface{}) error {
+
+	for k, v := range nested {
+		if m, ok := v.(map[string]interface{}); ok {
+			if err := injectNested(data, prefix+k+".", m); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := injectField(data, prefix+k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
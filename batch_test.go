@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+)
+
+// mockLibhoney points libhoney at a sender that keeps the events it's given,
+// for the length of a test.
+func mockLibhoney(t *testing.T) *transmission.MockSender {
+
+	t.Helper()
+	sender := &transmission.MockSender{}
+	if err := libhoney.Init(libhoney.Config{APIKey: "test", Dataset: "test", Transmission: sender}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(libhoney.Close)
+	return sender
+}
+
+// discardLibhoney points libhoney at a sender that drops every event, for
+// benchmarks that send more events than a MockSender should hold.
+func discardLibhoney(tb testing.TB) {
+
+	tb.Helper()
+	if err := libhoney.Init(libhoney.Config{APIKey: "test", Dataset: "test", Transmission: &transmission.DiscardSender{}}); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(libhoney.Close)
+}
+
+func TestSendBatchFromSharedBuilder(t *testing.T) {
+
+	defer func(batch bool) { batchByRequest = batch }(batchByRequest)
+	batchByRequest = true
+	sender := mockLibhoney(t)
+
+	in := newHeaderIngest(func(string) []string { return nil })
+	if in.builder == nil {
+		t.Fatal("expected the ingest to have a builder")
+	}
+	in.builder.AddField("request.shared", "yes")
+
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.Add(time.Minute)
+	in.sendBatch([]keptEvent{
+		{data: map[string]interface{}{"service": "a"}, rate: 5, key: "a", timestamp: first},
+		{data: map[string]interface{}{"service": "b", "only_b": true}, rate: 20, key: "b", timestamp: second},
+	})
+	in.finish()
+
+	events := sender.Events()
+	if len(events) != 2 {
+		t.Fatalf("sent %d events, want 2", len(events))
+	}
+	tests := []struct {
+		service   string
+		rate      uint
+		timestamp time.Time
+		onlyB     bool
+	}{
+		{"a", 5, first, false},
+		{"b", 20, second, true},
+	}
+	for i, tt := range tests {
+		ev := events[i]
+		if ev.Data["service"] != tt.service {
+			t.Errorf("event %d service = %v, want %s", i, ev.Data["service"], tt.service)
+		}
+		if ev.SampleRate != tt.rate {
+			t.Errorf("event %d sample rate = %d, want %d", i, ev.SampleRate, tt.rate)
+		}
+		if ev.Data[fieldName("honeylog.sample_rate")] != int(tt.rate) {
+			t.Errorf("event %d honeylog.sample_rate = %v, want %d", i, ev.Data[fieldName("honeylog.sample_rate")], tt.rate)
+		}
+		if ev.Data[metaField("samplekey")] != tt.service {
+			t.Errorf("event %d sample key = %v, want %s", i, ev.Data[metaField("samplekey")], tt.service)
+		}
+		if !ev.Timestamp.Equal(tt.timestamp) {
+			t.Errorf("event %d timestamp = %v, want %v", i, ev.Timestamp, tt.timestamp)
+		}
+		if ev.Data["request.shared"] != "yes" {
+			t.Errorf("event %d is missing the builder's field", i)
+		}
+		if _, ok := ev.Data["only_b"]; ok != tt.onlyB {
+			t.Errorf("event %d has only_b = %v, want %v", i, ok, tt.onlyB)
+		}
+	}
+	if in.success != 2 || in.sendErrors != 0 {
+		t.Errorf("success = %d, errors = %d, want 2 and 0", in.success, in.sendErrors)
+	}
+}
+
+func TestSendBatchCarriesRequestFieldsOnBuilder(t *testing.T) {
+
+	defer func(batch bool) { batchByRequest = batch }(batchByRequest)
+	batchByRequest = true
+	sender := mockLibhoney(t)
+
+	in := newHeaderIngest(func(string) []string { return nil })
+	in.fields = map[string]interface{}{"http.header.x-tenant-id": "acme"}
+	data := map[string]interface{}{"service": "a"}
+	if err := in.inject(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data["http.header.x-tenant-id"]; ok {
+		t.Error("request field was injected into the event, want it left to the builder")
+	}
+
+	in.sendBatch([]keptEvent{{data: data, rate: 1, key: "a"}})
+	in.finish()
+
+	events := sender.Events()
+	if len(events) != 1 {
+		t.Fatalf("sent %d events, want 1", len(events))
+	}
+	if got := events[0].Data["http.header.x-tenant-id"]; got != "acme" {
+		t.Errorf("http.header.x-tenant-id = %v, want acme from the builder", got)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "strings"
+
+var beelineCompat bool
+
+// beelineTraceFields maps the trace fields some Beeline versions and wrappers
+// record under meta to the names Honeycomb uses to assemble traces.
+var beelineTraceFields = map[string]string{
+	"meta.trace_id":  "trace.trace_id",
+	"meta.span_id":   "trace.span_id",
+	"meta.parent_id": "trace.parent_id",
+}
+
+// translateBeeline tidies up events carrying Beeline metadata so they show up
+// in Honeycomb as they would had the Beeline sent them itself. A nested meta
+// object is flattened into meta.* fields, and trace IDs found under meta are
+// moved to their trace.* fields unless the event already has them.
+func translateBeeline(data map[string]interface{}) {
+
+	if meta, ok := data["meta"].(map[string]interface{}); ok {
+		delete(data, "meta")
+		for k, v := range meta {
+			if _, exists := data["meta."+k]; !exists {
+				data["meta."+k] = v
+			}
+		}
+	}
+
+	hasMeta := false
+	for k := range data {
+		if strings.HasPrefix(k, "meta.") {
+			hasMeta = true
+			break
+		}
+	}
+	if !hasMeta {
+		return
+	}
+
+	for from, to := range beelineTraceFields {
+		v, ok := data[from]
+		if !ok {
+			continue
+		}
+		delete(data, from)
+		if _, exists := data[to]; !exists {
+			data[to] = v
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	BoolErrorDropEvent    = "drop_event"
+	BoolErrorDropField    = "drop_field"
+	BoolErrorKeepOriginal = "keep_original"
+)
+
+var boolFields []string
+var boolFieldErrorPolicy = BoolErrorKeepOriginal
+
+var boolFieldErrors = metrics.Counter("honeylog_bool_field_errors_total", "BOOL_FIELDS values that couldn't be read as booleans.")
+
+// coerceBoolFields turns the values of boolFields into booleans, so Honeycomb
+// types their columns as booleans even when emitters send "true" or 1. A value
+// that can't be read as a boolean is dropped, kept as it is, or causes an
+// error so the event is dropped, according to boolFieldErrorPolicy.
+func coerceBoolFields(data map[string]interface{}) error {
+
+	for _, f := range boolFields {
+		v, ok := data[f]
+		if !ok {
+			continue
+		}
+		if b, ok := parseBoolValue(v); ok {
+			data[f] = b
+			continue
+		}
+
+		boolFieldErrors.Inc()
+		switch boolFieldErrorPolicy {
+		case BoolErrorDropEvent:
+			return fmt.Errorf("field %s has non-boolean value %v", f, v)
+		case BoolErrorDropField:
+			delete(data, f)
+		}
+	}
+	return nil
+}
+
+// parseBoolValue reads true, "true", 1 and "1" as true, and false, "false", 0
+// and "0" as false. Strings are matched case-insensitively.
+func parseBoolValue(v interface{}) (value bool, ok bool) {
+
+	switch v := v.(type) {
+	case bool:
+		return v, true
+	case float64:
+		if v == 0 || v == 1 {
+			return v == 1, true
+		}
+	case int:
+		if v == 0 || v == 1 {
+			return v == 1, true
+		}
+	case int64:
+		if v == 0 || v == 1 {
+			return v == 1, true
+		}
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "1":
+			return true, true
+		case "false", "0":
+			return false, true
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	CasePreserve = "preserve"
+	CaseSnake    = "snake_case"
+	CaseCamel    = "camelCase"
+	CasePascal   = "PascalCase"
+)
+
+const (
+	InputCaseLower = "lower"
+	InputCaseUpper = "upper"
+	InputCaseSnake = "snake"
+)
+
+var fieldNameCase = CasePreserve
+
+// inputFieldCase normalizes the field names of incoming events before they
+// are cleaned up, except for those in inputFieldCaseExclude.
+var inputFieldCase = CasePreserve
+var inputFieldCaseExclude map[string]bool
+
+// validFieldNameCase reports whether style is a casing FIELD_NAME_CASE accepts.
+func validFieldNameCase(style string) bool {
+	switch style {
+	case CasePreserve, CaseSnake, CaseCamel, CasePascal:
+		return true
+	}
+	return false
+}
+
+// validInputFieldCase reports whether style is a casing INPUT_FIELD_CASE
+// accepts.
+func validInputFieldCase(style string) bool {
+	switch style {
+	case CasePreserve, InputCaseLower, InputCaseUpper, InputCaseSnake:
+		return true
+	}
+	return false
+}
+
+// fieldName converts a field name to the configured casing. Each dot
+// separated part is converted on its own, so namespaced names like
+// "request.user_agent" keep their structure. Converting an already converted
+// name leaves it unchanged.
+func fieldName(name string) string {
+
+	if fieldNameCase == CasePreserve {
+		return name
+	}
+
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = convertCase(part, fieldNameCase)
+	}
+	return strings.Join(parts, ".")
+}
+
+// convertCase joins the words of s in the given style, keeping any leading
+// underscores.
+func convertCase(s string, style string) string {
+
+	trimmed := strings.TrimLeft(s, "_")
+	prefix := s[:len(s)-len(trimmed)]
+
+	words := splitWords(trimmed)
+	if len(words) == 0 {
+		return s
+	}
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	for i, word := range words {
+		switch {
+		case style == CaseSnake:
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteString(word)
+		case style == CaseCamel && i == 0:
+			b.WriteString(word)
+		default:
+			r := []rune(word)
+			r[0] = unicode.ToUpper(r[0])
+			b.WriteString(string(r))
+		}
+	}
+	return b.String()
+}
+
+// splitWords breaks s into lower case words on underscores, hyphens and
+// spaces, and where the case changes. A run of capitals is one word, so
+// "HTTPStatus" splits into "http" and "status".
+func splitWords(s string) []string {
+
+	var words []string
+	var word []rune
+	runes := []rune(s)
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+
+	for i, r := range runes {
+		switch {
+		case r == '_' || r == '-' || r == ' ':
+			flush()
+			continue
+		case unicode.IsUpper(r) && i > 0:
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				flush()
+			}
+		}
+		word = append(word, r)
+	}
+	flush()
+	return words
+}
+
+// convertFieldNames renames every field of an event to the configured
+// casing. Where two fields convert to the same name, the one that already had
+// it wins.
+func convertFieldNames(data map[string]interface{}) {
+
+	if fieldNameCase == CasePreserve {
+		return
+	}
+
+	for k, v := range data {
+		converted := fieldName(k)
+		if converted == k {
+			continue
+		}
+		if _, exists := data[converted]; !exists {
+			data[converted] = v
+		}
+		delete(data, k)
+	}
+}
+
+// inputFieldName normalizes a field name to the configured input casing. As
+// with fieldName, snake casing converts each dot separated part on its own.
+func inputFieldName(name string) string {
+
+	switch inputFieldCase {
+	case InputCaseLower:
+		return strings.ToLower(name)
+	case InputCaseUpper:
+		return strings.ToUpper(name)
+	case InputCaseSnake:
+		parts := strings.Split(name, ".")
+		for i, part := range parts {
+			parts[i] = convertCase(part, CaseSnake)
+		}
+		return strings.Join(parts, ".")
+	}
+	return name
+}
+
+// normalizeInputFields renames the fields of an incoming event to the
+// configured input casing, leaving excluded fields alone. Where two fields
+// normalize to the same name, the one that already had it wins.
+func normalizeInputFields(data map[string]interface{}) {
+
+	if inputFieldCase == CasePreserve {
+		return
+	}
+
+	for k, v := range data {
+		if inputFieldCaseExclude[k] {
+			continue
+		}
+		normalized := inputFieldName(k)
+		if normalized == k {
+			continue
+		}
+		if _, exists := data[normalized]; !exists {
+			data[normalized] = v
+		}
+		delete(data, k)
+	}
+}
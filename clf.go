@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatCLF      = "clf"
+	FormatCombined = "combined"
+)
+
+// CLFTimeLayout is how access logs write their timestamps, e.g.
+// 10/Oct/2000:13:55:36 -0700.
+const CLFTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+var clfPattern = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}|-) (\d+|-)`)
+var combinedPattern = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}|-) (\d+|-) "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)"`)
+
+// readCLFLines processes a body of access log lines in Common Log Format or
+// the combined format, which adds the referer and user agent.
+func readCLFLines(in *ingest, body io.Reader, format string) {
+
+	scanner := bufio.NewScanner(body)
+	buf := make([]byte, MaxLineLength)
+	scanner.Buffer(buf, MaxLineLength)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		in.total++
+
+		data := getEventMap()
+		timestamp, err := parseCLF(line, format, data)
+		if err != nil {
+			in.logf("access log parsing error %v, raw data: %s\n", err, line)
+			in.parseErrors++
+			putEventMap(data)
+			continue
+		}
+
+		err = in.process(data, timestamp)
+		if err != nil {
+			in.logf("%v, raw data: %s\n", err, line)
+		}
+	}
+}
+
+// parseCLF adds the fields of an access log line to data and returns when
+// the request was logged. Fields logged as "-" are left out.
+func parseCLF(line string, format string, data map[string]interface{}) (time.Time, error) {
+
+	combined := format == FormatCombined
+	pattern := clfPattern
+	if combined {
+		pattern = combinedPattern
+	}
+	m := pattern.FindStringSubmatch(line)
+	if m == nil {
+		return time.Time{}, fmt.Errorf("line does not match the %s format", format)
+	}
+
+	timestamp, err := time.Parse(CLFTimeLayout, m[4])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", m[4])
+	}
+
+	setCLFField(data, "client_ip", m[1])
+	setCLFField(data, "ident", m[2])
+	setCLFField(data, "auth_user", m[3])
+	data["timestamp"] = timestamp.Format(time.RFC3339)
+	data["request"] = m[5]
+	if parts := strings.Fields(m[5]); len(parts) == 3 {
+		data["method"] = parts[0]
+		data["path"] = parts[1]
+		data["protocol"] = parts[2]
+	}
+	if status, err := strconv.Atoi(m[6]); err == nil {
+		data["status"] = status
+	}
+	if bytes, err := strconv.ParseInt(m[7], 10, 64); err == nil {
+		data["bytes_sent"] = bytes
+	}
+	if combined {
+		setCLFField(data, "referer", m[8])
+		setCLFField(data, "user_agent", m[9])
+	}
+	return timestamp, nil
+}
+
+func setCLFField(data map[string]interface{}, field, value string) {
+	if value != "-" && value != "" {
+		data[field] = value
+	}
+}
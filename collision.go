@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	CollisionOverwrite    = "overwrite"
+	CollisionKeepOriginal = "keep_original"
+	CollisionSuffix       = "suffix"
+	CollisionError        = "error"
+)
+
+var fieldCollisionPolicy = CollisionOverwrite
+
+var fieldCollisions = metrics.Counter("honeylog_field_collision_total", "Events dropped because a field honeylog added collided with one they already had.")
+
+// fieldCollisionError is returned when a field honeylog adds to an event is
+// already set and the collision policy is error.
+type fieldCollisionError struct {
+	field string
+}
+
+func (e *fieldCollisionError) Error() string {
+	return fmt.Sprintf("field %s is already set on the event", e.field)
+}
+
+// validCollisionPolicy reports whether policy is one FIELD_COLLISION_POLICY
+// accepts.
+func validCollisionPolicy(policy string) bool {
+	switch policy {
+	case CollisionOverwrite, CollisionKeepOriginal, CollisionSuffix, CollisionError:
+		return true
+	}
+	return false
+}
+
+// injectField sets a field honeylog derived on an event, resolving a
+// collision with a field the event already has according to
+// fieldCollisionPolicy: the value replaces the existing one, is skipped, is
+// stored under the first free key made by appending _1, _2 and so on, or an
+// error is returned so the event can be dropped. It returns the key the value
+// was stored under, which is empty if it was skipped.
+func injectField(data map[string]interface{}, k string, v interface{}) (string, error) {
+
+	if _, exists := data[k]; !exists || fieldCollisionPolicy == CollisionOverwrite {
+		data[k] = v
+		return k, nil
+	}
+
+	switch fieldCollisionPolicy {
+	case CollisionKeepOriginal:
+		return "", nil
+	case CollisionSuffix:
+		for i := 1; ; i++ {
+			key := k + "_" + strconv.Itoa(i)
+			if _, exists := data[key]; !exists {
+				data[key] = v
+				return key, nil
+			}
+		}
+	}
+	fieldCollisions.Inc()
+	return "", &fieldCollisionError{field: k}
+}
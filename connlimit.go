@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"golang.org/x/net/netutil"
+)
+
+var activeConnections int64
+
+var rejectedConnections = metrics.Counter("honeylog_rejected_connections_total", "Connections turned away with a 503 because SERVER_MAX_CONNS was reached.")
+
+// trackConnState keeps activeConnections up to date as an http.Server
+// ConnState hook.
+func trackConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&activeConnections, 1)
+	case http.StateClosed, http.StateHijacked:
+		atomic.AddInt64(&activeConnections, -1)
+	}
+}
+
+// limitListener caps the connections served from l at max. With the queue
+// overflow policy, connections beyond the limit wait to be accepted;
+// otherwise they are accepted and turned away with a 503 straight away.
+func limitListener(l net.Listener, max int, overflow string) net.Listener {
+	if overflow == "queue" {
+		return netutil.LimitListener(l, max)
+	}
+	return &rejectListener{Listener: l, sem: make(chan struct{}, max)}
+}
+
+// rejectResponse is what writeError would send, written by hand because the
+// connection never reaches the http.Server.
+var rejectResponse = []byte("HTTP/1.1 503 Service Unavailable\r\n" +
+	"Content-Type: application/json\r\n" +
+	"Content-Length: 61\r\n" +
+	"Connection: close\r\n\r\n" +
+	`{"error":"too many connections","code":"service_unavailable"}`)
+
+type rejectListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (l *rejectListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.sem <- struct{}{}:
+			return &limitedConn{Conn: c, release: func() { <-l.sem }}, nil
+		default:
+			rejectedConnections.Inc()
+			go func() {
+				c.Write(rejectResponse)
+				c.Close()
+			}()
+		}
+	}
+}
+
+// limitedConn gives its slot back to the listener once closed.
+type limitedConn struct {
+	net.Conn
+	closed  int32
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.release()
+	}
+	return err
+}
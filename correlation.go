@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+var correlationIDHeader = "X-Request-ID"
+
+// requestID returns the correlation ID a client sent with a request,
+// generating one if it didn't. A generated ID is stored on the request so
+// later calls return the same one.
+func requestID(r *http.Request) string {
+
+	id := r.Header.Get(correlationIDHeader)
+	if id == "" {
+		id = newUUID()
+		r.Header.Set(correlationIDHeader, id)
+	}
+	return id
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// logf logs a line about the ingest, tagged with its correlation ID.
+func (in *ingest) logf(format string, args ...interface{}) {
+	fmt.Printf("[%s] "+format, append([]interface{}{in.id}, args...)...)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultAggregateFlushIntervalSeconds = 60
+
+var counters *counterAggregator
+
+var countersAggregated = metrics.Counter("honeylog_counter_events_aggregated_total", "Counter events merged into an aggregate instead of being sampled.")
+
+// counterAggregator merges counter events from all requests that share the
+// values of its group by fields, summing its sum fields, and sends one event
+// per group each interval. Aggregated events are not sampled: each stands for
+// every event merged into it, so the totals are exact.
+type counterAggregator struct {
+	groupBy  []string
+	sum      []string
+	interval time.Duration
+
+	lock    sync.Mutex
+	groups  map[string]*counterGroup
+	order   []string
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// counterGroup is the running totals of one combination of group by values.
+type counterGroup struct {
+	data      map[string]interface{}
+	sums      map[string]float64
+	count     int
+	timestamp time.Time
+}
+
+func newCounterAggregator(groupBy, sum []string, interval time.Duration) *counterAggregator {
+	c := &counterAggregator{
+		groupBy:  groupBy,
+		sum:      sum,
+		interval: interval,
+		groups:   make(map[string]*counterGroup),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *counterAggregator) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flush()
+		case <-c.stop:
+			c.flush()
+			return
+		}
+	}
+}
+
+// add merges an event into its group and reports whether it did, taking
+// ownership of data if so. Events missing any of the group by fields aren't
+// counter events and are left to be sampled as usual, as are all events once
+// the aggregator has been stopped.
+func (c *counterAggregator) add(data map[string]interface{}, timestamp time.Time) bool {
+
+	values := make([]string, len(c.groupBy))
+	for i, field := range c.groupBy {
+		v, ok := data[field]
+		if !ok {
+			return false
+		}
+		values[i] = fmt.Sprintf("%v", v)
+	}
+	key := strings.Join(values, "\x00")
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stopped {
+		return false
+	}
+	g, ok := c.groups[key]
+	if !ok {
+		g = &counterGroup{
+			data:      make(map[string]interface{}, len(c.groupBy)+len(c.sum)+1),
+			sums:      make(map[string]float64, len(c.sum)),
+			timestamp: timestamp,
+		}
+		for _, field := range c.groupBy {
+			g.data[field] = data[field]
+		}
+		c.groups[key] = g
+		c.order = append(c.order, key)
+	}
+	for _, field := range c.sum {
+		if f, ok := numericValue(data[field]); ok {
+			g.sums[field] += f
+		}
+	}
+	g.count++
+	countersAggregated.Inc()
+	putEventMap(data)
+	return true
+}
+
+// flush sends an event for each group seen since the last flush, in the order
+// the groups were first seen.
+func (c *counterAggregator) flush() {
+
+	c.lock.Lock()
+	groups, order := c.groups, c.order
+	c.groups = make(map[string]*counterGroup)
+	c.order = nil
+	c.lock.Unlock()
+
+	events := make([]keptEvent, 0, len(order))
+	for _, key := range order {
+		g := groups[key]
+		for field, sum := range g.sums {
+			g.data[field] = sum
+		}
+		g.data[fieldName("honeylog.aggregated_count")] = g.count
+		events = append(events, keptEvent{
+			data:      g.data,
+			rate:      1,
+			key:       strings.Replace(key, "\x00", ",", -1),
+			count:     1,
+			timestamp: g.timestamp,
+			dataset:   eventDataset(g.data),
+		})
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	var sent int
+	if upstream != nil {
+		sent = forwardEvents(events)
+	} else {
+		for _, e := range events {
+			if err := sendEvent(nil, e); err != nil {
+				fmt.Printf("%v\n", err)
+				continue
+			}
+			sent++
+		}
+	}
+	eventsSent.Add(int64(sent))
+	if failed := int64(len(events) - sent); failed > 0 {
+		sendErrors.Add(failed)
+		errorRate.record(0, failed)
+	}
+}
+
+// Stop sends the groups still being aggregated and stops the background
+// flusher.
+func (c *counterAggregator) Stop() {
+	c.lock.Lock()
+	c.stopped = true
+	c.lock.Unlock()
+	close(c.stop)
+	<-c.done
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// readDatadogData accepts payloads in the Datadog Logs HTTP intake format, a
+// JSON array of log objects posted to <endpoint>/<api_key>. Datadog's reserved
+// attributes are mapped onto the field names we use elsewhere before the
+// events go through the normal pipeline.
+func readDatadogData(w http.ResponseWriter, r *http.Request) {
+
+	defer trackInFlight()()
+	w.Header().Set("X-Request-ID", requestID(r))
+	in := newIngest(r)
+
+	var entries []map[string]interface{}
+	err := json.NewDecoder(r.Body).Decode(&entries)
+	if err != nil {
+		in.logf("datadog json parsing error %v\n", err)
+		writeError(w, http.StatusBadRequest, ErrorInvalidBody, fmt.Sprintf("datadog json parsing error %v", err))
+		return
+	}
+
+	for _, data := range entries {
+		in.total++
+		if data == nil {
+			in.parseErrors++
+			continue
+		}
+		translateDatadog(data)
+		err = in.process(data, eventTimestamp(data))
+		if err != nil {
+			in.logf("%v\n", err)
+		}
+	}
+
+	in.finish()
+
+	writeResponse(w, in.status(), newIngestSummary(in), r)
+}
+
+// translateDatadog renames Datadog's reserved attributes and breaks ddtags out
+// into individual fields.
+func translateDatadog(data map[string]interface{}) {
+
+	if v, ok := data["ddsource"]; ok {
+		data["service"] = v
+		delete(data, "ddsource")
+	}
+	if v, ok := data["hostname"]; ok {
+		data["host"] = v
+		delete(data, "hostname")
+	}
+	if v, ok := data["ddtags"]; ok {
+		delete(data, "ddtags")
+		for _, tag := range strings.Split(fmt.Sprintf("%v", v), ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "" {
+				continue
+			}
+			// tags without a value are still worth recording
+			k, val, found := strings.Cut(tag, ":")
+			if !found {
+				data[k] = true
+				continue
+			}
+			data[k] = val
+		}
+	}
+}
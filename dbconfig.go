@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+const DefaultSamplingDBRefreshSeconds = 60
+
+// dbSamplingFields holds the []string of sampling fields last loaded from
+// the database, replacing HONEYCOMB_SAMPLING_FIELDS when set.
+var dbSamplingFields atomic.Value
+
+// dbGoalSampleRate is the goal sample rate last loaded from the database,
+// or 0 when it isn't set there and envGoalSampleRate applies.
+var dbGoalSampleRate int64
+
+// envGoalSampleRate is the sampler's goal rate from HONEYCOMB_SAMPLE_RATE,
+// restored when the database stops setting one.
+var envGoalSampleRate int
+
+// dbSamplingOverrides holds the []samplingOverride last loaded from the
+// database. They are checked after any from SAMPLING_OVERRIDE_FILE.
+var dbSamplingOverrides atomic.Value
+
+// currentSamplingFields returns the fields sampling keys are built from.
+func currentSamplingFields() []string {
+	if fields, ok := dbSamplingFields.Load().([]string); ok && len(fields) > 0 {
+		return fields
+	}
+	return samplingFields
+}
+
+// samplingConfigDB loads sampling configuration from the rows of a
+// sampling_config table:
+//
+//	sampling_fields    comma separated fields to build sampling keys from
+//	goal_sample_rate   the sampler's goal rate, replacing HONEYCOMB_SAMPLE_RATE
+//	override.<key>     sample rate for events matching <key>, which is a
+//	                   literal sampling key or field=value conditions as in
+//	                   SAMPLING_OVERRIDE_FILE
+type samplingConfigDB struct {
+	db    *sql.DB
+	query *sql.Stmt
+}
+
+// newSamplingConfigDB connects to the database at dsn and prepares the config
+// query. The connection itself is made lazily, so an unreachable database
+// doesn't prevent starting with the environment's configuration.
+func newSamplingConfigDB(dsn string) (*samplingConfigDB, error) {
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &samplingConfigDB{db: db}, nil
+}
+
+// load reads the sampling configuration and makes it current. On any error
+// the previously loaded configuration stays in place. Reloads, those with a
+// trigger, are recorded in the config audit log.
+func (c *samplingConfigDB) load(trigger string) error {
+
+	if c.query == nil {
+		stmt, err := c.db.Prepare("SELECT field, value FROM sampling_config")
+		if err != nil {
+			return err
+		}
+		c.query = stmt
+	}
+	rows, err := c.query.Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var fields []string
+	var goalRate int
+	overrides := []samplingOverride{}
+	for rows.Next() {
+		var field, value string
+		if err := rows.Scan(&field, &value); err != nil {
+			return err
+		}
+		switch {
+		case field == "sampling_fields":
+			fields = nil
+			for _, f := range strings.Split(value, ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					fields = append(fields, fieldName(f))
+				}
+			}
+		case field == "goal_sample_rate":
+			rate, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || rate < 1 {
+				return fmt.Errorf("invalid goal_sample_rate %q", value)
+			}
+			goalRate = rate
+		case strings.HasPrefix(field, "override."):
+			rate, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("invalid rate %q for %s", value, field)
+			}
+			overrides = append(overrides, samplingOverride{Key: strings.TrimPrefix(field, "override."), Rate: rate})
+		default:
+			fmt.Printf("warning: ignoring unknown sampling_config field %q\n", field)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := prepareSamplingOverrides(overrides); err != nil {
+		return err
+	}
+
+	// rows that have gone away fall back to the environment's config
+	before := dbConfigAuditValues()
+	if goalRate > 0 {
+		err = sampler.SetGoalSampleRate(goalRate)
+	} else {
+		err = sampler.SetGoalSampleRate(envGoalSampleRate)
+	}
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&dbGoalSampleRate, int64(goalRate))
+	dbSamplingFields.Store(fields)
+	dbSamplingOverrides.Store(overrides)
+	if trigger != "" {
+		configAudit.record(trigger, before, dbConfigAuditValues())
+	}
+	fmt.Printf("Loaded sampling config from database: %d fields, goal rate %d, %d overrides\n", len(fields), sampler.GoalSampleRate(), len(overrides))
+	return nil
+}
+
+// watch reloads the configuration every interval and on SIGHUP.
+func (c *samplingConfigDB) watch(interval time.Duration) {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			trigger := "timer"
+			select {
+			case <-ticker.C:
+			case <-hup:
+				trigger = "signal"
+			}
+			if err := c.load(trigger); err != nil {
+				fmt.Printf("error loading sampling config from database, keeping previous config: %v\n", err)
+			}
+		}
+	}()
+}
+
+// dbConfigAuditValues snapshots the configuration loaded from the database
+// for the audit log.
+func dbConfigAuditValues() map[string]interface{} {
+	overrides, _ := dbSamplingOverrides.Load().([]samplingOverride)
+	values := overrideAuditValues("database.override.", overrides)
+	if fields, ok := dbSamplingFields.Load().([]string); ok && len(fields) > 0 {
+		values["database.sampling_fields"] = fields
+	}
+	if rate := atomic.LoadInt64(&dbGoalSampleRate); rate > 0 {
+		values["database.goal_sample_rate"] = rate
+	}
+	return values
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDedupWindowSeconds = 60
+	MaxDedupWindowSeconds     = 3600
+	DefaultDedupMaxEntries    = 100000
+)
+
+var dedup *dedupCache
+
+var dedupDropped = metrics.Counter("honeylog_dedup_dropped_total", "Events dropped as duplicates of one seen within the dedup window.")
+
+// dedupCache remembers a hash of the DEDUP_FIELDS values of recent events so
+// duplicates, such as those from a shipper retrying a timed out request, can
+// be dropped. Entries expire after the window, and the least recently seen
+// entry is evicted when the cache is full.
+type dedupCache struct {
+	fields     []string
+	window     time.Duration
+	maxEntries int
+
+	lock    sync.Mutex
+	entries map[uint64]*list.Element
+	order   *list.List
+}
+
+type dedupEntry struct {
+	hash    uint64
+	expires time.Time
+}
+
+func newDedupCache(fields []string, window time.Duration, maxEntries int) *dedupCache {
+	return &dedupCache{
+		fields:     fields,
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[uint64]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// duplicate reports whether an event with the same dedup field values was
+// seen within the window, remembering the event if it wasn't. Events without
+// any of the dedup fields are never duplicates.
+func (c *dedupCache) duplicate(data map[string]interface{}) bool {
+
+	h := fnv.New64a()
+	found := false
+	for _, field := range c.fields {
+		val, ok := data[fieldName(field)]
+		if ok {
+			found = true
+		}
+		fmt.Fprintf(h, "%s\x00%t\x00%v\x00", field, ok, val)
+	}
+	if !found {
+		return false
+	}
+	hash := h.Sum64()
+	now := time.Now()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.entries[hash]; ok {
+		entry := el.Value.(*dedupEntry)
+		if now.Before(entry.expires) {
+			c.order.MoveToFront(el)
+			return true
+		}
+		entry.expires = now.Add(c.window)
+		c.order.MoveToFront(el)
+		return false
+	}
+
+	if len(c.entries) >= c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dedupEntry).hash)
+	}
+	c.entries[hash] = c.order.PushFront(&dedupEntry{hash: hash, expires: now.Add(c.window)})
+	return false
+}
+
+// Len returns the number of events being remembered.
+func (c *dedupCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
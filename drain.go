@@ -0,0 +1,33 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const DefaultDrainMaxWaitSeconds = 30
+
+var inFlightRequests int64
+
+// trackInFlight counts an ingest request as in flight until the function it
+// returns is called, so shutdown can wait for its events before flushing.
+func trackInFlight() func() {
+	atomic.AddInt64(&inFlightRequests, 1)
+	return func() {
+		atomic.AddInt64(&inFlightRequests, -1)
+	}
+}
+
+// waitForInFlight waits for in-flight requests to finish, up to maxWait. It
+// returns how many were still in flight when it gave up.
+func waitForInFlight(maxWait time.Duration) int64 {
+
+	deadline := time.Now().Add(maxWait)
+	for {
+		n := atomic.LoadInt64(&inFlightRequests)
+		if n == 0 || !time.Now().Before(deadline) {
+			return n
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
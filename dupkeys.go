@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	DuplicateKeyLast  = "last"
+	DuplicateKeyFirst = "first"
+	DuplicateKeyArray = "array"
+	DuplicateKeyError = "error"
+)
+
+var duplicateKeyPolicy = DuplicateKeyLast
+
+var duplicateKeys = metrics.Counter("honeylog_duplicate_key_total", "JSON events dropped for repeating a key.")
+
+// validDuplicateKeyPolicy reports whether policy is one DUPLICATE_KEY_POLICY
+// accepts.
+func validDuplicateKeyPolicy(policy string) bool {
+	switch policy {
+	case DuplicateKeyLast, DuplicateKeyFirst, DuplicateKeyArray, DuplicateKeyError:
+		return true
+	}
+	return false
+}
+
+// unmarshalEvent decodes a JSON object into data, resolving keys that appear
+// more than once at the top level according to duplicateKeyPolicy: the last
+// or first value wins, all the values are collected in a slice, or it is an
+// error. encoding/json always keeps the last value, so the other policies
+// walk the object's tokens instead.
+func unmarshalEvent(raw []byte, data map[string]interface{}) error {
+
+	if duplicateKeyPolicy == DuplicateKeyLast {
+		return json.Unmarshal(raw, &data)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return errors.New("event is not a JSON object")
+	}
+
+	// keys whose values have been collected into a slice by the array policy
+	var collected map[string]bool
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return err
+		}
+
+		existing, dup := data[key]
+		if !dup {
+			data[key] = v
+			continue
+		}
+		switch duplicateKeyPolicy {
+		case DuplicateKeyError:
+			duplicateKeys.Inc()
+			return fmt.Errorf("key %q appears more than once", key)
+		case DuplicateKeyArray:
+			if collected[key] {
+				data[key] = append(existing.([]interface{}), v)
+				continue
+			}
+			if collected == nil {
+				collected = make(map[string]bool)
+			}
+			collected[key] = true
+			data[key] = []interface{}{existing, v}
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON object")
+	}
+	return nil
+}
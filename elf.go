@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const FormatW3CELF = "w3c_elf"
+
+// readELFLines processes a body in the W3C Extended Log Format used by IIS
+// and some CDNs. Directive lines starting with # describe the data lines
+// after them: #Fields names their space separated columns, and #Date and
+// #Version are added to each of them as log.date and log.version.
+func readELFLines(in *ingest, body io.Reader) {
+
+	scanner := bufio.NewScanner(body)
+	buf := make([]byte, MaxLineLength)
+	scanner.Buffer(buf, MaxLineLength)
+
+	var fields []string
+	var logDate, logVersion string
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			directive, value, _ := strings.Cut(line[1:], ":")
+			value = strings.TrimSpace(value)
+			switch directive {
+			case "Fields":
+				fields = strings.Fields(value)
+			case "Date":
+				logDate = value
+			case "Version":
+				logVersion = value
+			}
+			continue
+		}
+		in.total++
+
+		values := strings.Fields(line)
+		if len(fields) == 0 || len(values) != len(fields) {
+			in.logf("w3c elf parsing error %s, raw data: %s\n", elfFieldCountError(fields, values), line)
+			in.parseErrors++
+			continue
+		}
+
+		data := getEventMap()
+		for i, field := range fields {
+			// ELF logs empty values as a dash
+			if values[i] != "-" {
+				data[field] = values[i]
+			}
+		}
+		if logDate != "" {
+			data["log.date"] = logDate
+		}
+		if logVersion != "" {
+			data["log.version"] = logVersion
+		}
+
+		err := in.process(data, elfTimestamp(fields, values))
+		if err != nil {
+			in.logf("%v, raw data: %s\n", err, line)
+		}
+	}
+}
+
+func elfFieldCountError(fields, values []string) string {
+	if len(fields) == 0 {
+		return "data line before any #Fields directive"
+	}
+	return fmt.Sprintf("%d values for %d fields", len(values), len(fields))
+}
+
+// elfTimestamp returns when a data line was logged from its date and time
+// fields, which ELF records in UTC, or the zero time if it doesn't have them.
+func elfTimestamp(fields, values []string) time.Time {
+
+	var date, clock string
+	for i, field := range fields {
+		switch field {
+		case "date":
+			date = values[i]
+		case "time":
+			clock = values[i]
+		}
+	}
+	if date == "" || clock == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", date+" "+clock)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	DefaultEnrichmentCacheTTLSeconds = 60
+	DefaultEnrichmentTimeoutMS       = 50
+	EnrichmentPrefix                 = "enrichment."
+)
+
+var enricher *redisEnricher
+
+var (
+	enrichmentMisses = metrics.Counter("honeylog_enrichment_misses_total", "Enrichment lookups that found nothing in Redis.")
+	enrichmentErrors = metrics.Counter("honeylog_enrichment_errors_total", "Enrichment lookups that failed or timed out.")
+)
+
+// redisEnricher adds the data stored in Redis under the value of an event's
+// enrichment field to the event. Lookups are cached locally, misses included,
+// so a busy key costs one Redis call per TTL, and each lookup is bounded by a
+// timeout so enrichment can't hold up an event for long.
+type redisEnricher struct {
+	client  *redis.Client
+	field   string
+	ttl     time.Duration
+	timeout time.Duration
+
+	lock  sync.Mutex
+	cache map[string]enrichmentEntry
+}
+
+type enrichmentEntry struct {
+	fields  map[string]interface{}
+	expires time.Time
+}
+
+// newRedisEnricher configures enrichment from the environment. It returns nil
+// when REDIS_ENRICHMENT_URL is not set.
+func newRedisEnricher() (*redisEnricher, error) {
+
+	rawURL := os.Getenv("REDIS_ENRICHMENT_URL")
+	if rawURL == "" {
+		return nil, nil
+	}
+	field := os.Getenv("REDIS_ENRICHMENT_FIELD")
+	if field == "" {
+		return nil, fmt.Errorf("REDIS_ENRICHMENT_FIELD must be set")
+	}
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	timeout := envInt("REDIS_ENRICHMENT_TIMEOUT_MS", DefaultEnrichmentTimeoutMS)
+	if timeout <= 0 {
+		timeout = DefaultEnrichmentTimeoutMS
+	}
+	opts.ReadTimeout = time.Duration(timeout) * time.Millisecond
+	opts.WriteTimeout = opts.ReadTimeout
+
+	return &redisEnricher{
+		client:  redis.NewClient(opts),
+		field:   field,
+		ttl:     time.Duration(envInt("REDIS_ENRICHMENT_CACHE_TTL_SECONDS", DefaultEnrichmentCacheTTLSeconds)) * time.Second,
+		timeout: opts.ReadTimeout,
+		cache:   make(map[string]enrichmentEntry),
+	}, nil
+}
+
+// enrich merges the enrichment data for an event into it, each field
+// prefixed with EnrichmentPrefix. Events without the enrichment field, and
+// those whose lookup misses or fails, are left as they are. An error is
+// returned if a field collides with an existing one under the error collision
+// policy.
+func (e *redisEnricher) enrich(data map[string]interface{}) error {
+
+	val, ok := data[e.field]
+	if !ok || val == nil {
+		return nil
+	}
+	for k, v := range e.lookup(fmt.Sprintf("%v", val)) {
+		if _, err := injectField(data, EnrichmentPrefix+k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *redisEnricher) lookup(key string) map[string]interface{} {
+
+	now := time.Now()
+	e.lock.Lock()
+	entry, ok := e.cache[key]
+	e.lock.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.fields
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	raw, err := e.client.Get(ctx, key).Bytes()
+	var fields map[string]interface{}
+	switch {
+	case err == redis.Nil:
+		enrichmentMisses.Inc()
+	case err != nil:
+		// don't cache failures, Redis may be back for the next event
+		enrichmentErrors.Inc()
+		return nil
+	default:
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			enrichmentErrors.Inc()
+			fmt.Printf("enrichment data for %q is not a JSON object: %v\n", key, err)
+		}
+	}
+
+	if e.ttl > 0 {
+		e.lock.Lock()
+		e.cache[key] = enrichmentEntry{fields: fields, expires: now.Add(e.ttl)}
+		e.lock.Unlock()
+	}
+	return fields
+}
+
+// expireLoop removes expired entries from the cache once a TTL, so keys that
+// aren't seen again don't stay in memory.
+func (e *redisEnricher) expireLoop() {
+	if e.ttl <= 0 {
+		return
+	}
+	for range time.Tick(e.ttl) {
+		now := time.Now()
+		e.lock.Lock()
+		for k, entry := range e.cache {
+			if !now.Before(entry.expires) {
+				delete(e.cache, k)
+			}
+		}
+		e.lock.Unlock()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envString returns the named environment variable, or def if it is unset.
+func envString(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envBool reports whether the named environment variable is set to a true
+// value as understood by strconv.ParseBool. Unset or invalid values are false.
+func envBool(name string) bool {
+	b, _ := strconv.ParseBool(os.Getenv(name))
+	return b
+}
+
+// envBoolDefault is envBool with def used when the named environment
+// variable is unset or invalid.
+func envBoolDefault(name string, def bool) bool {
+	b, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// envInt returns the named environment variable as an int, or def if it is
+// unset or not a valid integer.
+func envInt(name string, def int) int {
+	i, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return i
+}
+
+// envList splits a comma-separated environment variable into its trimmed,
+// non-empty values.
+func envList(name string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
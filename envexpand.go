@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	envExpandFields []string
+	envExpandVars   map[string]string
+)
+
+var envExpandMissing = metrics.Counter("honeylog_env_expand_missing_var_total", "References in ENV_EXPAND_FIELDS values to environment variables that weren't set or allowed by ENV_EXPAND_VARS, replaced with nothing.")
+
+// envExpandDeniedPrefixes and envExpandDeniedWords mark variables that
+// ENV_EXPAND_VARS may not name: honeylog's own settings, and anything that
+// looks like a secret or a URL that may carry credentials.
+var (
+	envExpandDeniedPrefixes = []string{"HONEYCOMB_", "HONEYLOG_", "LIBHONEY_", "PROXY_AUTH_", "TLS_"}
+	envExpandDeniedWords    = []string{"KEY", "TOKEN", "SECRET", "PASSWORD", "PASSWD", "CREDENTIAL", "DSN", "URL"}
+)
+
+// loadEnvExpandVars records the startup values of the variables named in
+// ENV_EXPAND_VARS, which are all ENV_EXPAND_FIELDS values may be expanded
+// from. Clients choose what is expanded, so naming a variable that may hold
+// a secret is an error rather than a way to leak it into Honeycomb.
+func loadEnvExpandVars(names []string) (map[string]string, error) {
+
+	vars := make(map[string]string, len(names))
+	for _, name := range names {
+		upper := strings.ToUpper(name)
+		for _, prefix := range envExpandDeniedPrefixes {
+			if strings.HasPrefix(upper, prefix) {
+				return nil, fmt.Errorf("ENV_EXPAND_VARS can't include honeylog's own setting %s", name)
+			}
+		}
+		for _, word := range envExpandDeniedWords {
+			if strings.Contains(upper, word) {
+				return nil, fmt.Errorf("ENV_EXPAND_VARS can't include %s, which may hold a secret", name)
+			}
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			vars[name] = v
+		}
+	}
+	return vars, nil
+}
+
+// expandEnvFields replaces $VAR and ${VAR} references in the values of
+// envExpandFields with the startup values of the variables allowed by
+// ENV_EXPAND_VARS, as os.ExpandEnv does. References to any other variable
+// become empty. Values are read as strings, and left alone if they have no
+// references.
+func expandEnvFields(data map[string]interface{}) {
+
+	for _, f := range envExpandFields {
+		v, ok := data[f]
+		if !ok || v == nil {
+			continue
+		}
+		s := fmt.Sprintf("%v", v)
+		if !strings.Contains(s, "$") {
+			continue
+		}
+		data[f] = os.Expand(s, func(name string) string {
+			val, ok := envExpandVars[name]
+			if !ok {
+				envExpandMissing.Inc()
+			}
+			return val
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExpandEnvFieldsOnlyAllowedVars(t *testing.T) {
+
+	defer func(fields []string, vars map[string]string) {
+		envExpandFields, envExpandVars = fields, vars
+	}(envExpandFields, envExpandVars)
+
+	t.Setenv("HONEYCOMB_API_KEY", "secret")
+	t.Setenv("REGION", "eu-west-1")
+	t.Setenv("ZONE", "b")
+
+	vars, err := loadEnvExpandVars([]string{"REGION"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envExpandFields, envExpandVars = []string{"location"}, vars
+
+	data := map[string]interface{}{"location": "$REGION/${ZONE}/$HONEYCOMB_API_KEY"}
+	expandEnvFields(data)
+	if data["location"] != "eu-west-1//" {
+		t.Errorf("location = %q, want only REGION expanded", data["location"])
+	}
+}
+
+func TestLoadEnvExpandVarsRefusesSecrets(t *testing.T) {
+
+	for _, name := range []string{"HONEYCOMB_API_KEY", "HONEYCOMB_INGEST_TOKEN", "LIBHONEY_PROXY_URL", "SAMPLING_CONFIG_DB_URL", "REDIS_ENRICHMENT_URL", "PROXY_AUTH_PASSWORD", "AWS_SECRET_ACCESS_KEY", "honeylog_field_namespace"} {
+		if _, err := loadEnvExpandVars([]string{"REGION", name}); err == nil {
+			t.Errorf("%s was allowed", name)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/libhoney-go"
+)
+
+var sendErrors = metrics.Counter("honeylog_send_errors_total", "Kept events that could not be sent.")
+
+// errorRate tracks events and errors over a sliding window, and exits the
+// process when the error fraction goes over the threshold. A threshold of 0
+// disables it.
+var errorRate *errorRateMonitor
+
+type errorRateMonitor struct {
+	threshold float64
+	cooldown  time.Duration
+	window    *slidingWindow
+	exit      sync.Once
+}
+
+// record adds the outcome of some processing to the window, and checks the
+// error rate. The check is held off until the process has been up for the
+// cooldown, so a supervisor can't restart us in a tight loop.
+func (m *errorRateMonitor) record(events, errors int64) {
+
+	if m == nil {
+		return
+	}
+	m.window.Add(events, errors)
+	if time.Since(startTime) < m.cooldown {
+		return
+	}
+
+	total, failed := m.window.Totals()
+	if total == 0 || float64(failed)/float64(total) <= m.threshold {
+		return
+	}
+	m.exit.Do(func() {
+		fmt.Printf("fatal error: %d errors in %d events over the last %v exceeds error rate threshold %v\n",
+			failed, total, m.window.Duration(), m.threshold)
+		libhoney.Flush()
+		os.Exit(110)
+	})
+}
+
+// slidingWindow counts events and errors in one second buckets over a window.
+type slidingWindow struct {
+	lock    sync.Mutex
+	seconds []int64
+	events  []int64
+	errors  []int64
+}
+
+func newSlidingWindow(size int) *slidingWindow {
+	return &slidingWindow{
+		seconds: make([]int64, size),
+		events:  make([]int64, size),
+		errors:  make([]int64, size),
+	}
+}
+
+func (s *slidingWindow) Add(events, errors int64) {
+	now := time.Now().Unix()
+	i := int(now % int64(len(s.seconds)))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.seconds[i] != now {
+		s.seconds[i] = now
+		s.events[i] = 0
+		s.errors[i] = 0
+	}
+	s.events[i] += events
+	s.errors[i] += errors
+}
+
+// Totals returns the counts from buckets that are still inside the window.
+func (s *slidingWindow) Totals() (events, errors int64) {
+	oldest := time.Now().Unix() - int64(len(s.seconds))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, sec := range s.seconds {
+		if sec > oldest {
+			events += s.events[i]
+			errors += s.errors[i]
+		}
+	}
+	return events, errors
+}
+
+func (s *slidingWindow) Duration() time.Duration {
+	return time.Duration(len(s.seconds)) * time.Second
+}
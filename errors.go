@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes returned in error response bodies. These are stable so log
+// shippers can match on them; add new ones rather than changing these.
+const (
+	ErrorBodyTooLarge        = "body_too_large"
+	ErrorAuthFailed          = "auth_failed"
+	ErrorClientCertRejected  = "client_cert_rejected"
+	ErrorRateLimited         = "rate_limited"
+	ErrorServiceUnavailable  = "service_unavailable"
+	ErrorBadContentEncoding  = "bad_content_encoding"
+	ErrorInvalidBody         = "invalid_body"
+	ErrorInvalidRequest      = "invalid_request"
+	ErrorMethodNotAllowed    = "method_not_allowed"
+	ErrorInternalServerError = "internal_error"
+)
+
+// errorResponse is the body of every error response.
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// writeError responds with status and a JSON body describing the error.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+
+	body, _ := json.Marshal(errorResponse{Error: message, Code: code})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
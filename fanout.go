@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+var fanOutRules []fanOutRule
+
+// fanOutRule sends events whose fields all match to each of its datasets.
+type fanOutRule struct {
+	Match    map[string]string `yaml:"match"`
+	Datasets []string          `yaml:"datasets"`
+}
+
+// loadFanOutRules reads a YAML list of fan out rules.
+func loadFanOutRules(path string) ([]fanOutRule, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []fanOutRule
+	if err := yaml.Unmarshal(raw, &rules); err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if len(rule.Match) == 0 {
+			return nil, fmt.Errorf("fan out rule %d has no match", i+1)
+		}
+		if len(rule.Datasets) == 0 {
+			return nil, fmt.Errorf("fan out rule %d has no datasets", i+1)
+		}
+	}
+	return rules, nil
+}
+
+// fanOutDatasets returns every dataset an event should be sent to, across all
+// the rules it matches, or nil if it matches none.
+func fanOutDatasets(data map[string]interface{}) []string {
+
+	var datasets []string
+	seen := make(map[string]bool)
+	for _, rule := range fanOutRules {
+		if !rule.matches(data) {
+			continue
+		}
+		for _, dataset := range rule.Datasets {
+			if !seen[dataset] {
+				seen[dataset] = true
+				datasets = append(datasets, dataset)
+			}
+		}
+	}
+	return datasets
+}
+
+func (r *fanOutRule) matches(data map[string]interface{}) bool {
+	for field, value := range r.Match {
+		v, ok := data[field]
+		if !ok || fmt.Sprintf("%v", v) != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var fieldOverrides map[string]string
+
+// parseFieldOverrides reads FIELD_OVERRIDES style field=value pairs.
+func parseFieldOverrides(pairs []string) (map[string]string, error) {
+
+	overrides := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		field := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || field == "" {
+			return nil, fmt.Errorf("invalid field override %q, expected field=value", pair)
+		}
+		overrides[field] = parts[1]
+	}
+	return overrides, nil
+}
+
+// applyFieldOverrides sets every overridden field to its configured value,
+// whether or not the event already had it. This runs before any other
+// cleanup so nothing derived from an event ever sees the original value.
+func applyFieldOverrides(data map[string]interface{}) {
+	for field, value := range fieldOverrides {
+		data[field] = value
+	}
+}
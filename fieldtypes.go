@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"reflect"
+)
+
+const DefaultTypeAnnotationSuffix = ".type"
+
+var annotateFieldTypes bool
+var typeAnnotationSuffix = DefaultTypeAnnotationSuffix
+var annotatedFields map[string]bool
+
+// annotateTypes adds a companion field naming the type of each field's value,
+// so fields whose type varies between events can be found. Only the fields in
+// annotatedFields are annotated, or every field if it is empty. An error is
+// returned if a companion field collides with an existing one under the error
+// collision policy.
+func annotateTypes(data map[string]interface{}) error {
+
+	if !annotateFieldTypes {
+		return nil
+	}
+
+	types := make(map[string]string, len(data))
+	for k, v := range data {
+		if len(annotatedFields) == 0 || annotatedFields[k] {
+			types[k+typeAnnotationSuffix] = valueType(v)
+		}
+	}
+	for k, t := range types {
+		if _, err := injectField(data, k, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valueType names the type of a decoded value: string, int, float, bool,
+// null, slice or object. JSON numbers decode as floats, so whole ones are
+// reported as ints.
+func valueType(v interface{}) string {
+
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "int"
+	case float32:
+		return floatType(float64(v))
+	case float64:
+		return floatType(v)
+	}
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.Slice, reflect.Array:
+		return "slice"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return "string"
+}
+
+func floatType(f float64) string {
+	if f == math.Trunc(f) && !math.IsInf(f, 0) {
+		return "int"
+	}
+	return "float"
+}
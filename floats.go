@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+const (
+	NaNPolicyNull   = "null"
+	NaNPolicyZero   = "zero"
+	NaNPolicyString = "string"
+)
+
+const DefaultFloatPrecision = 6
+
+const DefaultNumericPrecisionDigits = 6
+
+var nanPolicy = NaNPolicyNull
+var floatPrecision = DefaultFloatPrecision
+var floatToIntIfWhole bool
+var numericPrecisionFields map[string]bool
+var numericPrecisionDigits = DefaultNumericPrecisionDigits
+
+// validNaNPolicy reports whether policy is one NAN_POLICY accepts.
+func validNaNPolicy(policy string) bool {
+	switch policy {
+	case NaNPolicyNull, NaNPolicyZero, NaNPolicyString:
+		return true
+	}
+	return false
+}
+
+// normalizeFloats makes float values safe and tidy to encode. NaN and the
+// infinities, which JSON can't represent, are replaced according to
+// nanPolicy. Other floats are rounded to floatPrecision decimal places, and
+// whole ones become integers if floatToIntIfWhole is set. Fields listed in
+// numericPrecisionFields are instead rounded to numericPrecisionDigits
+// significant figures, and always become integers when whole, so values
+// serialized differently by different languages compare equal.
+func normalizeFloats(data map[string]interface{}) {
+
+	for k, v := range data {
+		var f float64
+		switch n := v.(type) {
+		case float64:
+			f = n
+		case float32:
+			f = float64(n)
+		default:
+			continue
+		}
+
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			switch nanPolicy {
+			case NaNPolicyZero:
+				data[k] = 0
+			case NaNPolicyString:
+				data[k] = strconv.FormatFloat(f, 'g', -1, 64)
+			default:
+				data[k] = nil
+			}
+			continue
+		}
+
+		toInt := floatToIntIfWhole
+		if numericPrecisionFields[k] {
+			if rounded, err := strconv.ParseFloat(strconv.FormatFloat(f, 'g', numericPrecisionDigits, 64), 64); err == nil {
+				f = rounded
+			}
+			toInt = true
+		} else if floatPrecision >= 0 {
+			if rounded, err := strconv.ParseFloat(strconv.FormatFloat(f, 'f', floatPrecision, 64), 64); err == nil {
+				f = rounded
+			}
+		}
+		if toInt && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			data[k] = int64(f)
+			continue
+		}
+		data[k] = f
+	}
+}
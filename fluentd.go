@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var fluentdCompat bool
+
+// fluentdEventTime is Fluentd's EventTime msgpack extension, which carries
+// nanosecond precision timestamps as ext type 0.
+type fluentdEventTime time.Time
+
+func init() {
+	msgpack.RegisterExt(0, (*fluentdEventTime)(nil))
+}
+
+func (t *fluentdEventTime) MarshalMsgpack() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(time.Time(*t).Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(time.Time(*t).Nanosecond()))
+	return b, nil
+}
+
+func (t *fluentdEventTime) UnmarshalMsgpack(b []byte) error {
+	if len(b) != 8 {
+		return fmt.Errorf("invalid fluentd event time length %d", len(b))
+	}
+	sec := binary.BigEndian.Uint32(b)
+	nsec := binary.BigEndian.Uint32(b[4:])
+	*t = fluentdEventTime(time.Unix(int64(sec), int64(nsec)))
+	return nil
+}
+
+// isFluentdRequest reports whether a request body should be read as an array
+// of Fluentd [tag, time, record] tuples. MessagePack bodies always are; JSON
+// bodies are only when they open with an array, so regular NDJSON clients can
+// keep posting to the same endpoint.
+func isFluentdRequest(r *http.Request, body *bufio.Reader) bool {
+
+	switch requestMediaType(r) {
+	case "application/msgpack", "application/x-msgpack":
+		return true
+	case "application/json":
+		for {
+			b, err := body.Peek(1)
+			if err != nil {
+				return false
+			}
+			switch b[0] {
+			case ' ', '\t', '\r', '\n':
+				body.ReadByte()
+			default:
+				return b[0] == '['
+			}
+		}
+	}
+	return false
+}
+
+// requestMediaType returns the media type of a request body, without any
+// parameters.
+func requestMediaType(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType
+}
+
+// readFluentdEntries decodes a Fluentd out_http payload sent with the given
+// media type and processes the record of each entry, tagging it with the
+// Fluentd tag.
+func readFluentdEntries(in *ingest, mediaType string, body io.Reader) error {
+
+	var entries [][]interface{}
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(body).Decode(&entries); err != nil {
+			return fmt.Errorf("fluentd json parsing error %v", err)
+		}
+	} else {
+		if err := msgpack.NewDecoder(body).Decode(&entries); err != nil {
+			return fmt.Errorf("fluentd msgpack parsing error %v", err)
+		}
+	}
+
+	for _, entry := range entries {
+		in.total++
+
+		if len(entry) != 3 {
+			in.parseErrors++
+			in.logf("fluentd entry has %d elements, expected 3\n", len(entry))
+			continue
+		}
+		record, ok := entry[2].(map[string]interface{})
+		if !ok {
+			in.parseErrors++
+			in.logf("fluentd entry record is %T, expected a map\n", entry[2])
+			continue
+		}
+		for k, v := range record {
+			// msgpack raw strings decode as bytes
+			if b, ok := v.([]byte); ok {
+				record[k] = string(b)
+			}
+		}
+		record["fluentd.tag"] = fmt.Sprintf("%v", entry[0])
+
+		err := in.process(record, fluentdTime(entry[1]))
+		if err != nil {
+			in.logf("%v\n", err)
+		}
+	}
+	return nil
+}
+
+// fluentdTime converts the time element of a Fluentd entry, which is either
+// an EventTime or unix seconds.
+func fluentdTime(v interface{}) time.Time {
+
+	if t, ok := v.(*fluentdEventTime); ok {
+		return time.Time(*t)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return time.Unix(rv.Int(), 0)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return time.Unix(int64(rv.Uint()), 0)
+	case reflect.Float32, reflect.Float64:
+		sec, frac := math.Modf(rv.Float())
+		return time.Unix(int64(sec), int64(frac*1e9))
+	}
+	return time.Time{}
+}
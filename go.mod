@@ -3,17 +3,35 @@ module http-honeylog
 go 1.18
 
 require (
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/go-redis/redis/v8 v8.11.5
+	github.com/gorilla/websocket v1.5.0
 	github.com/honeycombio/dynsampler-go v0.2.1
 	github.com/honeycombio/libhoney-go v1.15.8
 	github.com/honeycombio/urlshaper v0.0.0-20211228212415-ac8d7d936154
+	github.com/lib/pq v1.10.7
+	github.com/segmentio/kafka-go v0.4.38
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	go.opentelemetry.io/proto/otlp v0.19.0
+	golang.org/x/net v0.0.0-20220706163947-c90051bbdb60
+	google.golang.org/grpc v1.42.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/facebookgo/clock v0.0.0-20150410010913-600d898af40a // indirect
 	github.com/facebookgo/limitgroup v0.0.0-20150612190941-6abd8d71ec01 // indirect
 	github.com/facebookgo/muster v0.0.0-20150708232844-fd3d7953fd52 // indirect
-	github.com/klauspost/compress v1.13.6 // indirect
-	github.com/vmihailenco/msgpack/v5 v5.3.5 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/grpc-ecosystem/grpc-gateway/v2 v2.7.0 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/sys v0.0.0-20220908164124-27713097b956 // indirect
+	golang.org/x/text v0.3.7 // indirect
+	google.golang.org/genproto v0.0.0-20211118181313-81c1377c94b1 // indirect
 	gopkg.in/alexcesaro/statsd.v2 v2.0.0 // indirect
 )
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/honeycombio/dynsampler-go"
+)
+
+var keyGoalRates *keyGoalRateSamplers
+
+// keyGoalRateSamplers gives events matching a SAMPLING_KEY_GOAL_RATES pattern
+// their own EMA sampler with the pattern's goal rate, instead of the global
+// sampler. Patterns take the same form as sampling override keys: field=value
+// conditions that must all match the event, or a literal sampling key.
+// Samplers are started the first time a pattern matches, each tracking at
+// most maxKeys keys.
+type keyGoalRateSamplers struct {
+	patterns []samplingOverride
+	maxKeys  int
+
+	lock     sync.Mutex
+	samplers map[string]*dynsampler.EMASampleRate
+}
+
+// parseKeyGoalRates reads a JSON object of patterns to goal rates. It returns
+// nil if raw is empty.
+func parseKeyGoalRates(raw string, maxKeys int) (*keyGoalRateSamplers, error) {
+
+	if raw == "" {
+		return nil, nil
+	}
+	var rates map[string]int
+	if err := json.Unmarshal([]byte(raw), &rates); err != nil {
+		return nil, err
+	}
+	patterns := make([]samplingOverride, 0, len(rates))
+	for key, rate := range rates {
+		patterns = append(patterns, samplingOverride{Key: key, Rate: rate})
+	}
+	// the first matching pattern wins, so make that the same one every time
+	sort.Slice(patterns, func(i, j int) bool { return patterns[i].Key < patterns[j].Key })
+	if err := prepareSamplingOverrides(patterns); err != nil {
+		return nil, err
+	}
+	return &keyGoalRateSamplers{
+		patterns: patterns,
+		maxKeys:  maxKeys,
+		samplers: make(map[string]*dynsampler.EMASampleRate),
+	}, nil
+}
+
+// samplerFor returns the sampler for the first pattern matching an event, or
+// nil if none match.
+func (k *keyGoalRateSamplers) samplerFor(data map[string]interface{}, key string) *dynsampler.EMASampleRate {
+
+	if k == nil {
+		return nil
+	}
+	for i := range k.patterns {
+		p := &k.patterns[i]
+		if !p.matches(data, key) {
+			continue
+		}
+
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		s, ok := k.samplers[p.Key]
+		if !ok {
+			s = &dynsampler.EMASampleRate{GoalSampleRate: p.Rate, MaxKeys: k.maxKeys}
+			if err := s.Start(); err != nil {
+				fmt.Printf("error starting sampler for %q, using the global sampler: %v\n", p.Key, err)
+				return nil
+			}
+			k.samplers[p.Key] = s
+		}
+		return s
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+
+	"http-honeylog/logingestion"
+)
+
+// grpcIngestServer feeds log records streamed over gRPC into the same
+// pipeline as events posted over HTTP.
+type grpcIngestServer struct {
+	logingestion.UnimplementedLogIngestionServer
+}
+
+// IngestLogs processes each record of a stream as it arrives, treating the
+// whole stream like a single HTTP request. Sampling header fields are read
+// from the stream's metadata.
+func (s *grpcIngestServer) IngestLogs(stream logingestion.LogIngestion_IngestLogsServer) error {
+
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	in := newHeaderIngest(func(name string) []string {
+		return md.Get(strings.ToLower(name))
+	})
+
+	for {
+		record, err := stream.Recv()
+		if err == io.EOF {
+			in.finish()
+			return stream.SendAndClose(&logingestion.IngestResponse{
+				Received: int64(in.total),
+				Sent:     int64(in.success),
+				Errors:   int64(in.parseErrors + in.sendErrors),
+			})
+		}
+		if err != nil {
+			in.finish()
+			return err
+		}
+		in.total++
+
+		data := getEventMap()
+		for k, v := range record.GetFields() {
+			if val := grpcValue(v); val != nil {
+				data[k] = val
+			}
+		}
+
+		err = in.process(data, eventTimestamp(data))
+		if err != nil {
+			in.logf("%v\n", err)
+		}
+	}
+}
+
+// grpcValue converts a field value to a plain Go value. Nulls become nil.
+func grpcValue(v *logingestion.Value) interface{} {
+
+	switch kind := v.GetKind().(type) {
+	case *logingestion.Value_StringValue:
+		return kind.StringValue
+	case *logingestion.Value_IntValue:
+		return kind.IntValue
+	case *logingestion.Value_FloatValue:
+		return kind.FloatValue
+	case *logingestion.Value_BoolValue:
+		return kind.BoolValue
+	case *logingestion.Value_StructValue:
+		out := make(map[string]interface{}, len(kind.StructValue.GetFields()))
+		for k, fv := range kind.StructValue.GetFields() {
+			if val := grpcValue(fv); val != nil {
+				out[k] = val
+			}
+		}
+		return out
+	case *logingestion.Value_ListValue:
+		out := make([]interface{}, 0, len(kind.ListValue.GetValues()))
+		for _, lv := range kind.ListValue.GetValues() {
+			out = append(out, grpcValue(lv))
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	HeaderPolicyFirst = "first"
+	HeaderPolicyLast  = "last"
+	HeaderPolicyAll   = "all"
+	HeaderPolicyJoin  = "join"
+)
+
+var headerValueSeparator = ","
+var headerMultiValuePolicy = HeaderPolicyJoin
+var forwardRequestHeaders []string
+var headerFieldPrefix = "http.header."
+
+// validHeaderPolicy reports whether policy is one HEADER_MULTI_VALUE_POLICY
+// accepts.
+func validHeaderPolicy(policy string) bool {
+	switch policy {
+	case HeaderPolicyFirst, HeaderPolicyLast, HeaderPolicyAll, HeaderPolicyJoin:
+		return true
+	}
+	return false
+}
+
+// headerValue reduces every value a sampling header field was sent with to
+// one sampling key value. Values may come from repeated headers or be comma
+// separated within one, as proxies add to X-Forwarded-For. first and last
+// pick one value in the order they were sent, all joins them in that order,
+// and join sorts them first so the order they arrived in doesn't matter.
+func headerValue(lines []string) string {
+
+	var values []string
+	for _, line := range lines {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return ""
+	}
+
+	switch headerMultiValuePolicy {
+	case HeaderPolicyFirst:
+		return values[0]
+	case HeaderPolicyLast:
+		return values[len(values)-1]
+	case HeaderPolicyJoin:
+		sort.Strings(values)
+	}
+	return strings.Join(values, headerValueSeparator)
+}
+
+// requestHeaderFields returns the FORWARD_REQUEST_HEADERS a request was sent
+// with as fields named with headerFieldPrefix and the lowercased header name.
+// Headers the request doesn't have are left out.
+func requestHeaderFields(header http.Header) map[string]interface{} {
+
+	var fields map[string]interface{}
+	for _, name := range forwardRequestHeaders {
+		value := headerValue(header.Values(name))
+		if value == "" {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]interface{}, len(forwardRequestHeaders))
+		}
+		fields[headerFieldPrefix+strings.ToLower(http.CanonicalHeaderKey(name))] = value
+	}
+	return fields
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	libhoney "github.com/honeycombio/libhoney-go"
+)
+
+// Version is reported to Honeycomb in the user agent, the parser field and
+// heartbeat events.
+const Version = "0.1"
+
+// heartbeat sends an event every interval whatever the log volume, so charts
+// don't have gaps during quiet spells and a gap in heartbeats means honeylog
+// itself is down.
+type heartbeat struct {
+	interval time.Duration
+	hostname string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newHeartbeat(interval time.Duration) *heartbeat {
+	hostname, err := os.Hostname()
+	if err != nil {
+		fmt.Printf("heartbeat can't read hostname: %v\n", err)
+	}
+	h := &heartbeat{
+		interval: interval,
+		hostname: hostname,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+func (h *heartbeat) run() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	lastReceived, lastSent := linesReceived.Value(), eventsSent.Value()
+	for {
+		select {
+		case <-ticker.C:
+			received, sent := linesReceived.Value(), eventsSent.Value()
+			h.send(received-lastReceived, sent-lastSent)
+			lastReceived, lastSent = received, sent
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// send emits a heartbeat straight to Honeycomb, unsampled, with the lines
+// received and events sent since the last one.
+func (h *heartbeat) send(received, sent int64) {
+
+	ev := libhoney.NewEvent()
+	ev.SampleRate = 1
+	ev.AddField(fieldName("honeylog.heartbeat"), true)
+	ev.AddField(fieldName("honeylog.version"), Version)
+	ev.AddField(fieldName("honeylog.hostname"), h.hostname)
+	ev.AddField(fieldName("lines_received_since_last_heartbeat"), received)
+	ev.AddField(fieldName("lines_sent_since_last_heartbeat"), sent)
+	if err := ev.SendPresampled(); err != nil {
+		fmt.Printf("heartbeat send error %v\n", err)
+	}
+}
+
+// Stop stops sending heartbeats.
+func (h *heartbeat) Stop() {
+	close(h.stop)
+	<-h.done
+}
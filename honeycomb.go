@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// DryRunDataset is used for dry runs that don't name a dataset, since
+// libhoney won't take an event without one.
+const DryRunDataset = "http-honeylog"
+
+var dryRun bool
+
+// honeycombAPIKeyPattern matches the shapes Honeycomb API keys come in: 32
+// character classic keys, 22 character environment keys, and ingest keys.
+var honeycombAPIKeyPattern = regexp.MustCompile(`^([0-9a-f]{32}|[0-9A-Za-z]{22}|hc[a-z]ik_[0-9A-Za-z]+)$`)
+
+// checkHoneycombConfig validates the settings libhoney needs to send events
+// to Honeycomb, unless nothing will be sent there. A missing setting is an
+// error naming the variable to set. A key that doesn't look like a Honeycomb
+// API key is only a warning, since Honeycomb is the judge of that.
+func checkHoneycombConfig(apiKey, dataset string) (warnings []string, err error) {
+
+	// events forwarded upstream only reach Honeycomb from the upstream
+	if dryRun || (os.Getenv("UPSTREAM_URL") != "" && !envBool("UPSTREAM_FALLBACK")) {
+		return nil, nil
+	}
+
+	var missing []string
+	if apiKey == "" {
+		missing = append(missing, "HONEYCOMB_API_KEY")
+	}
+	if dataset == "" {
+		missing = append(missing, "HONEYCOMB_DATASET")
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s must be set to send events to Honeycomb, or set DRY_RUN=true to print them instead", strings.Join(missing, " and "))
+	}
+
+	if !honeycombAPIKeyPattern.MatchString(apiKey) {
+		warnings = append(warnings, "HONEYCOMB_API_KEY does not look like a Honeycomb API key, events may be rejected. Set PREFLIGHT_CHECK=true to verify it at startup")
+	}
+	return warnings, nil
+}
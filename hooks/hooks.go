@@ -0,0 +1,36 @@
+// Package hooks lets code built into honeylog run its own logic as events
+// are sent. Register hooks from an init function in a package that
+// honeylog's main package imports, the way database/sql drivers register
+// themselves.
+package hooks
+
+import "sync"
+
+// PostSendHook is called with each event after it has been handed to
+// libhoney, along with the sampling decision made for it. data is a copy of
+// the event shared by every hook, so hooks must not modify it, but may keep
+// reading it after they return.
+type PostSendHook func(data map[string]interface{}, sampleRate int, key string)
+
+var (
+	postSendHooksMu sync.RWMutex
+	postSendHooks   []PostSendHook
+)
+
+// RegisterPostSendHook adds fn to the hooks called after each successful
+// send. Hooks run in the order they were registered, synchronously with the
+// send, so each is given at most POST_SEND_HOOK_TIMEOUT_MS before honeylog
+// moves on without it.
+func RegisterPostSendHook(fn PostSendHook) {
+	postSendHooksMu.Lock()
+	defer postSendHooksMu.Unlock()
+	postSendHooks = append(postSendHooks, fn)
+}
+
+// PostSendHooks returns the registered hooks in the order they were
+// registered.
+func PostSendHooks() []PostSendHook {
+	postSendHooksMu.RLock()
+	defer postSendHooksMu.RUnlock()
+	return postSendHooks
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// primaryHostIP returns the first non-loopback address of this host,
+// preferring IPv4 over IPv6.
+func primaryHostIP() (string, error) {
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+
+	var v6 string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+		if v6 == "" {
+			v6 = ipnet.IP.String()
+		}
+	}
+	if v6 == "" {
+		return "", errors.New("no non-loopback address found")
+	}
+	return v6, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const DefaultAutoDetectBytes = 512
+
+const (
+	FormatJSON    = "json"
+	FormatLogfmt  = "logfmt"
+	FormatMsgpack = "msgpack"
+)
+
+var inputFormat = FormatJSON
+var autoDetectFormat bool
+var autoDetectBytes = DefaultAutoDetectBytes
+
+// validInputFormat reports whether format is one honeylog can read.
+func validInputFormat(format string) bool {
+	switch format {
+	case FormatJSON, FormatLogfmt, FormatMsgpack, FormatCLF, FormatCombined, FormatW3CELF:
+		return true
+	}
+	return false
+}
+
+// detectInputFormat guesses the format of a request body from its first
+// bytes, without consuming them. It returns an empty string when nothing in
+// the first n bytes gives the format away.
+func detectInputFormat(body *bufio.Reader, n int) string {
+
+	b, _ := body.Peek(n)
+	s := strings.TrimLeft(string(b), " \t\r\n")
+	if s == "" {
+		return ""
+	}
+
+	switch c := s[0]; {
+	case c == '{' || c == '[':
+		return FormatJSON
+	case c >= 0x80 && c <= 0x9f, c >= 0xdc && c <= 0xdf:
+		// fixmap, fixarray, array 16/32 and map 16/32
+		return FormatMsgpack
+	}
+
+	// logfmt opens with a printable key followed by an equals sign
+	for i, r := range s {
+		switch {
+		case r == '=':
+			if i > 0 {
+				return FormatLogfmt
+			}
+			return ""
+		case r == ' ' || r == '"' || !unicode.IsPrint(r):
+			return ""
+		}
+	}
+	return ""
+}
+
+// readInput processes a request body in the given format.
+func readInput(in *ingest, body io.Reader, format string) {
+
+	switch format {
+	case FormatLogfmt:
+		readLogfmtLines(in, body)
+	case FormatMsgpack:
+		readMsgpackStream(in, body)
+	case FormatCLF, FormatCombined:
+		readCLFLines(in, body, format)
+	case FormatW3CELF:
+		readELFLines(in, body)
+	default:
+		if streamingDecode {
+			readJSONStream(in, body)
+		} else {
+			readJSONLines(in, body)
+		}
+	}
+}
+
+// readLogfmtLines processes a body of logfmt lines. Values are kept as
+// strings, and keys without a value are set to true.
+func readLogfmtLines(in *ingest, body io.Reader) {
+
+	scanner := bufio.NewScanner(body)
+	buf := make([]byte, MaxLineLength)
+	scanner.Buffer(buf, MaxLineLength)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		in.total++
+
+		data := getEventMap()
+		var err error
+		if !parseLine([]byte(line), data) {
+			err = parseLogfmt(line, data)
+		}
+		if err != nil {
+			in.logf("logfmt parsing error %v, raw data: %s\n", err, line)
+			in.parseErrors++
+			putEventMap(data)
+			continue
+		}
+
+		err = in.process(data, eventTimestamp(data))
+		if err != nil {
+			in.logf("%v, raw data: %s\n", err, line)
+		}
+	}
+}
+
+// parseLogfmt adds the key=value pairs of a logfmt line to data.
+func parseLogfmt(line string, data map[string]interface{}) error {
+
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '\t' {
+			if line[i] == '"' {
+				return fmt.Errorf("unexpected quote in key at offset %d", i)
+			}
+			i++
+		}
+		key := line[start:i]
+		if key == "" {
+			return fmt.Errorf("missing key at offset %d", start)
+		}
+		if i >= len(line) || line[i] != '=' {
+			data[key] = true
+			continue
+		}
+		i++
+
+		if i < len(line) && line[i] == '"' {
+			var value strings.Builder
+			i++
+			for {
+				if i >= len(line) {
+					return fmt.Errorf("unterminated quoted value for %s", key)
+				}
+				c := line[i]
+				i++
+				if c == '"' {
+					break
+				}
+				if c == '\\' && i < len(line) {
+					c = line[i]
+					i++
+					switch c {
+					case 'n':
+						c = '\n'
+					case 't':
+						c = '\t'
+					}
+				}
+				value.WriteByte(c)
+			}
+			data[key] = value.String()
+			continue
+		}
+
+		start = i
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		data[key] = line[start:i]
+	}
+	return nil
+}
+
+// readMsgpackStream processes a body of consecutive MessagePack maps. Like
+// readJSONStream, the rest of the body is abandoned on a decode error.
+func readMsgpackStream(in *ingest, body io.Reader) {
+
+	dec := msgpack.NewDecoder(body)
+
+	for {
+		data := getEventMap()
+		err := dec.Decode(&data)
+		if err == io.EOF {
+			putEventMap(data)
+			return
+		}
+		in.total++
+		if err != nil {
+			in.parseErrors++
+			putEventMap(data)
+			in.logf("msgpack parsing error %v, abandoning remaining body\n", err)
+			return
+		}
+		// nil decodes to a nil map, which can't be written to
+		if data == nil {
+			in.parseErrors++
+			in.logf("msgpack parsing error event is nil, not a map\n")
+			continue
+		}
+		for k, v := range data {
+			// msgpack raw strings decode as bytes
+			if b, ok := v.([]byte); ok {
+				data[k] = string(b)
+			}
+		}
+
+		err = in.process(data, eventTimestamp(data))
+		if err != nil {
+			in.logf("%v\n", err)
+		}
+	}
+}
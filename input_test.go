@@ -0,0 +1,16 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadMsgpackStreamNilEvent(t *testing.T) {
+
+	// two msgpack nils
+	in := newHeaderIngest(func(string) []string { return nil })
+	readMsgpackStream(in, bytes.NewReader([]byte{0xc0, 0xc0}))
+	if in.total != 2 || in.parseErrors != 2 {
+		t.Errorf("total = %d, parse errors = %d, want 2 and 2", in.total, in.parseErrors)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ipRanges holds the current []ipRange table, replaced as a whole on reload.
+var ipRanges atomic.Value
+
+// ipRange is a CIDR range and the fields injected into events from clients in
+// it.
+type ipRange struct {
+	cidr   string
+	net    *net.IPNet
+	fields map[string]interface{}
+}
+
+// loadIPRanges reads a YAML mapping of CIDR ranges to fields, keeping the
+// ranges in the order they appear in the file.
+func loadIPRanges(path string) ([]ipRange, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	mapping := doc.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("expected a mapping of CIDR ranges to fields")
+	}
+
+	ranges := make([]ipRange, 0, len(mapping.Content)/2)
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		cidr := mapping.Content[i].Value
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q: %v", cidr, err)
+		}
+		var fields map[string]interface{}
+		if err := mapping.Content[i+1].Decode(&fields); err != nil {
+			return nil, fmt.Errorf("invalid fields for %s: %v", cidr, err)
+		}
+		ranges = append(ranges, ipRange{cidr: cidr, net: ipNet, fields: fields})
+	}
+	return ranges, nil
+}
+
+// watchIPRanges reloads the CIDR table from path on SIGHUP, keeping the
+// previous table if the file can't be loaded.
+func watchIPRanges(path string) {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			ranges, err := loadIPRanges(path)
+			if err != nil {
+				fmt.Printf("error loading IP range fields, keeping previous ranges: %v\n", err)
+				continue
+			}
+			before := ipRangeAuditValues()
+			ipRanges.Store(ranges)
+			configAudit.record("signal", before, ipRangeAuditValues())
+			fmt.Printf("Loaded %d IP ranges\n", len(ranges))
+		}
+	}()
+}
+
+// ipRangeFields returns the fields to inject for every range the request's
+// client IP falls in. When ranges set the same field, the one later in the
+// file wins.
+func ipRangeFields(r *http.Request) map[string]interface{} {
+
+	ranges, _ := ipRanges.Load().([]ipRange)
+	if len(ranges) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return nil
+	}
+
+	var fields map[string]interface{}
+	for _, rng := range ranges {
+		if !rng.net.Contains(ip) {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]interface{})
+		}
+		for k, v := range rng.fields {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// clientIP returns the address of the client that sent a request: the first
+// address in X-Forwarded-For if a proxy added one, or the connection's remote
+// address otherwise.
+func clientIP(r *http.Request) string {
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		first, _, _ := strings.Cut(xff, ",")
+		return strings.TrimSpace(first)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ipRangeAuditValues snapshots the CIDR table for the audit log.
+func ipRangeAuditValues() map[string]interface{} {
+	ranges, _ := ipRanges.Load().([]ipRange)
+	values := make(map[string]interface{})
+	for _, rng := range ranges {
+		for k, v := range rng.fields {
+			values["ip_range."+rng.cidr+"."+k] = v
+		}
+	}
+	return values
+}
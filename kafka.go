@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	KafkaRetryInitialDelay = time.Second
+	KafkaRetryMaxDelay     = 30 * time.Second
+)
+
+var (
+	kafkaMessages = metrics.Counter("honeylog_kafka_messages_total", "Messages consumed from the Kafka input topic.")
+	kafkaPanics   = metrics.Counter("honeylog_kafka_message_panics_total", "Kafka messages skipped because processing them panicked.")
+)
+
+// kafkaConsumer reads events from a Kafka topic as a member of a consumer
+// group. Each message is a single event in INPUT_FORMAT. A message's offset is
+// only committed once its event has been sent or dropped by the sampler, so
+// delivery is at least once.
+type kafkaConsumer struct {
+	reader *kafka.Reader
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newKafkaConsumer configures a consumer from the environment. It returns nil
+// when KAFKA_INPUT_BROKERS is not set.
+func newKafkaConsumer() (*kafkaConsumer, error) {
+
+	brokers := envList("KAFKA_INPUT_BROKERS")
+	if len(brokers) == 0 {
+		return nil, nil
+	}
+	topic := os.Getenv("KAFKA_INPUT_TOPIC")
+	if topic == "" {
+		return nil, errors.New("KAFKA_INPUT_TOPIC must be set")
+	}
+	groupID := os.Getenv("KAFKA_INPUT_GROUP_ID")
+	if groupID == "" {
+		return nil, errors.New("KAFKA_INPUT_GROUP_ID must be set")
+	}
+
+	var startOffset int64
+	switch reset := strings.ToLower(envString("KAFKA_INPUT_OFFSET_RESET", "latest")); reset {
+	case "earliest":
+		startOffset = kafka.FirstOffset
+	case "latest":
+		startOffset = kafka.LastOffset
+	default:
+		return nil, fmt.Errorf("KAFKA_INPUT_OFFSET_RESET must be earliest or latest, not %q", reset)
+	}
+
+	return &kafkaConsumer{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     brokers,
+			Topic:       topic,
+			GroupID:     groupID,
+			StartOffset: startOffset,
+		}),
+		done: make(chan struct{}),
+	}, nil
+}
+
+// Start consumes messages in the background until Stop is called.
+func (c *kafkaConsumer) Start() {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+
+	metrics.Gauge("honeylog_kafka_consumer_lag", "Messages in the Kafka input topic not yet consumed.", func() float64 {
+		return float64(c.reader.Stats().Lag)
+	})
+
+	go c.run(ctx)
+}
+
+func (c *kafkaConsumer) run(ctx context.Context) {
+	defer close(c.done)
+
+	for {
+		msg, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Printf("kafka fetch error %v\n", err)
+			}
+			return
+		}
+		kafkaMessages.Inc()
+
+		// keep trying a message that couldn't be sent rather than skipping it
+		delay := KafkaRetryInitialDelay
+		for !c.process(msg) {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			if delay *= 2; delay > KafkaRetryMaxDelay {
+				delay = KafkaRetryMaxDelay
+			}
+		}
+
+		if err := c.reader.CommitMessages(ctx, msg); err != nil && ctx.Err() == nil {
+			fmt.Printf("kafka commit error %v\n", err)
+		}
+	}
+}
+
+// process runs a message through the pipeline, reading sampling header fields
+// from its headers. It returns false if the event should be retried because
+// it could not be sent. Messages that can't be parsed never will be, so they
+// are logged and skipped, as are messages whose processing panics, rather
+// than taking down the HTTP server with the consumer.
+func (c *kafkaConsumer) process(msg kafka.Message) (ok bool) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("kafka message at %s/%d offset %d skipped after panic: %v\n", msg.Topic, msg.Partition, msg.Offset, r)
+			kafkaPanics.Inc()
+			ok = true
+		}
+	}()
+
+	in := newHeaderIngest(func(name string) []string {
+		var values []string
+		for _, h := range msg.Headers {
+			if strings.EqualFold(h.Key, name) {
+				values = append(values, string(h.Value))
+			}
+		}
+		return values
+	})
+
+	readInput(in, bytes.NewReader(msg.Value), inputFormat)
+	in.finish()
+
+	if in.sendErrors > 0 {
+		in.logf("kafka message at %s/%d offset %d not sent, will retry\n", msg.Topic, msg.Partition, msg.Offset)
+		return false
+	}
+	return true
+}
+
+// Stop stops consuming and closes the connection to Kafka. A message that was
+// being processed is left uncommitted, to be consumed again.
+func (c *kafkaConsumer) Stop() {
+	c.cancel()
+	<-c.done
+	if err := c.reader.Close(); err != nil {
+		fmt.Printf("error closing kafka reader: %v\n", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKafkaProcessNullMessage(t *testing.T) {
+
+	defer func(format string, streaming bool) {
+		inputFormat, streamingDecode = format, streaming
+	}(inputFormat, streamingDecode)
+
+	tests := []struct {
+		name      string
+		format    string
+		streaming bool
+		value     []byte
+	}{
+		{"json lines", FormatJSON, false, []byte("null")},
+		{"json stream", FormatJSON, true, []byte("null")},
+		{"msgpack", FormatMsgpack, false, []byte{0xc0}},
+	}
+	c := &kafkaConsumer{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputFormat, streamingDecode = tt.format, tt.streaming
+			if !c.process(kafka.Message{Topic: "events", Value: tt.value}) {
+				t.Error("a null message should be skipped, not retried")
+			}
+		})
+	}
+}
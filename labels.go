@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultK8sLabelsFile = "/etc/podinfo/labels"
+const DefaultK8sAnnotationsFile = "/etc/podinfo/annotations"
+const DefaultDockerSocket = "/var/run/docker.sock"
+
+// readDownwardAPIFile parses a Kubernetes Downward API labels or annotations
+// file, which holds one key="quoted value" pair per line.
+func readDownwardAPIFile(path string) (map[string]string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, MaxLineLength), MaxLineLength)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed line %q in %s", line, path)
+		}
+		value, err := strconv.Unquote(parts[1])
+		if err != nil {
+			value = parts[1]
+		}
+		values[parts[0]] = value
+	}
+	return values, scanner.Err()
+}
+
+// dockerContainerLabels asks the Docker API on a local socket for the labels
+// of the container we're running in, which Docker names after our hostname
+// unless told otherwise.
+func dockerContainerLabels(socket string) (map[string]string, error) {
+
+	id := os.Getenv("DOCKER_CONTAINER_ID")
+	if id == "" {
+		var err error
+		if id, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := client.Get("http://docker/containers/" + url.PathEscape(id) + "/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("docker API responded %s for container %s", resp.Status, id)
+	}
+
+	var container struct {
+		Config struct {
+			Labels map[string]string
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&container); err != nil {
+		return nil, err
+	}
+	return container.Config.Labels, nil
+}
+
+// instanceLabels collects the labels and annotations of the pod or container
+// honeylog is running in from each enabled source, keyed by their prefixed
+// field names.
+func instanceLabels() (map[string]string, error) {
+
+	fields := make(map[string]string)
+	add := func(prefix string, labels map[string]string, err error) error {
+		if err != nil {
+			return err
+		}
+		for name, value := range labels {
+			fields[prefix+name] = value
+		}
+		return nil
+	}
+
+	if envBool("K8S_POD_LABELS_INJECT") {
+		labels, err := readDownwardAPIFile(envString("K8S_LABELS_FILE", DefaultK8sLabelsFile))
+		if err := add(envString("K8S_LABEL_PREFIX", "k8s.label."), labels, err); err != nil {
+			return nil, err
+		}
+	}
+	if envBool("K8S_POD_ANNOTATIONS_INJECT") {
+		annotations, err := readDownwardAPIFile(envString("K8S_ANNOTATIONS_FILE", DefaultK8sAnnotationsFile))
+		if err := add(envString("K8S_ANNOTATION_PREFIX", "k8s.annotation."), annotations, err); err != nil {
+			return nil, err
+		}
+	}
+	if envBool("DOCKER_CONTAINER_LABELS_INJECT") {
+		labels, err := dockerContainerLabels(envString("DOCKER_SOCKET", DefaultDockerSocket))
+		if err := add(envString("DOCKER_LABEL_PREFIX", "docker.label."), labels, err); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
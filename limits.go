@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"unicode/utf8"
+)
+
+// TruncatedSuffix marks a string value that was cut short by the field
+// length limits.
+const TruncatedSuffix = "_truncated"
+
+const DefaultMaxEventSizeBytes = 100 * 1024
+
+const (
+	OversizeTruncate = "truncate"
+	OversizeDrop     = "drop"
+)
+
+var maxFieldsPerEvent int
+var requiredFields []string
+var fieldPriorityList []string
+var sortFields bool
+var fieldMaxLength int
+var fieldMaxLengthOverrides map[string]int
+var maxEventSize = DefaultMaxEventSizeBytes
+var oversizeEventPolicy = OversizeTruncate
+
+var (
+	oversizeTruncated = metrics.LabeledCounter("honeylog_oversize_events_total", `action="truncate"`, "Kept events over MAX_EVENT_SIZE_BYTES, by what was done with them.")
+	oversizeDropped   = metrics.LabeledCounter("honeylog_oversize_events_total", `action="drop"`, "Kept events over MAX_EVENT_SIZE_BYTES, by what was done with them.")
+)
+
+// parseFieldMaxLengthOverrides reads a JSON object of field names to their
+// maximum lengths.
+func parseFieldMaxLengthOverrides(raw string) (map[string]int, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var overrides map[string]int
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// limitFieldLengths truncates string values longer than their field's limit,
+// counted in characters, and marks them with TruncatedSuffix. Fields with an
+// override use it in place of fieldMaxLength; a limit of 0 means no limit.
+// Values that aren't strings are left alone.
+func limitFieldLengths(data map[string]interface{}) {
+
+	if fieldMaxLength <= 0 && len(fieldMaxLengthOverrides) == 0 {
+		return
+	}
+	for k, v := range data {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		limit, ok := fieldMaxLengthOverrides[k]
+		if !ok {
+			limit = fieldMaxLength
+		}
+		if limit <= 0 || len(s) <= limit || utf8.RuneCountInString(s) <= limit {
+			continue
+		}
+		runes := []rune(s)
+		data[k] = string(runes[:limit]) + TruncatedSuffix
+	}
+}
+
+// limitFields prunes an event down to maxFieldsPerEvent fields, keeping them
+// in the order fieldsByPriority gives. Room is left for the two fields
+// recording that it was pruned.
+func limitFields(data map[string]interface{}) {
+
+	if maxFieldsPerEvent <= 0 || len(data) <= maxFieldsPerEvent {
+		return
+	}
+	originalCount := len(data)
+
+	keep := maxFieldsPerEvent - 2
+	if keep < 0 {
+		keep = 0
+	}
+	for _, k := range fieldsByPriority(data)[keep:] {
+		delete(data, k)
+	}
+	data[fieldName("honeylog.fields_truncated")] = true
+	data[fieldName("honeylog.original_field_count")] = originalCount
+}
+
+// fieldsByPriority returns the fields of an event in the order they should be
+// kept when it has to be cut down: required and sampling fields first, then
+// fields from the priority list, then the rest in alphabetical order.
+func fieldsByPriority(data map[string]interface{}) []string {
+
+	names := make([]string, 0, len(data))
+	seen := make(map[string]bool, len(data))
+	add := func(fields []string) {
+		for _, f := range fields {
+			if _, ok := data[f]; ok && !seen[f] {
+				names = append(names, f)
+				seen[f] = true
+			}
+		}
+	}
+	add(requiredFields)
+	add(currentSamplingFields())
+	add(fieldPriorityList)
+
+	rest := len(names)
+	for k := range data {
+		if !seen[k] {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names[rest:])
+	return names
+}
+
+// limitEventSize checks the JSON encoded size of an event against
+// maxEventSize, which libhoney would otherwise silently drop it for exceeding.
+// Oversize events are either reported as to be dropped or, with the truncate
+// policy, have their lowest priority fields removed until they fit. It
+// reports whether the event should still be sent.
+func limitEventSize(data map[string]interface{}) bool {
+
+	if maxEventSize <= 0 {
+		return true
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(data); err != nil {
+		// leave it to libhoney to report
+		return true
+	}
+	size := buf.Len() - 1
+	if size <= maxEventSize {
+		return true
+	}
+	if oversizeEventPolicy == OversizeDrop {
+		oversizeDropped.Inc()
+		return false
+	}
+
+	names := fieldsByPriority(data)
+	truncated := fieldName("honeylog.size_truncated")
+	data[truncated] = true
+	size += encodedFieldSize(truncated, true)
+	for i := len(names) - 1; i >= 0 && size > maxEventSize; i-- {
+		size -= encodedFieldSize(names[i], data[names[i]])
+		delete(data, names[i])
+	}
+	oversizeTruncated.Inc()
+	return true
+}
+
+// encodedFieldSize is the number of bytes a field adds to an event encoded as
+// a JSON object, including the separating comma.
+func encodedFieldSize(k string, v interface{}) int {
+
+	key, _ := json.Marshal(k)
+	val, _ := json.Marshal(v)
+	return len(key) + len(val) + 2
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLimitFields(t *testing.T) {
+
+	defer func(max int, required, sampling, priority []string) {
+		maxFieldsPerEvent, requiredFields, samplingFields, fieldPriorityList = max, required, sampling, priority
+	}(maxFieldsPerEvent, requiredFields, samplingFields, fieldPriorityList)
+
+	tests := []struct {
+		name     string
+		max      int
+		required []string
+		sampling []string
+		priority []string
+		fields   []string
+		want     []string
+	}{
+		// a pruned event keeps two fewer of its own fields than the limit, to
+		// make room for the fields recording that it was pruned
+		{
+			name:   "unlimited",
+			max:    0,
+			fields: []string{"a", "b", "c"},
+			want:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "within limit",
+			max:    3,
+			fields: []string{"a", "b", "c"},
+			want:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "alphabetical when nothing is prioritized",
+			max:    4,
+			fields: []string{"d", "c", "b", "a", "zz1", "zz2"},
+			want:   []string{"a", "b"},
+		},
+		{
+			name:     "required before sampling before priority before the rest",
+			max:      6,
+			required: []string{"z"},
+			sampling: []string{"y"},
+			priority: []string{"x"},
+			fields:   []string{"a", "b", "x", "y", "z", "zz1", "zz2"},
+			want:     []string{"a", "x", "y", "z"},
+		},
+		{
+			name:     "required fields win over sampling fields",
+			max:      3,
+			required: []string{"z"},
+			sampling: []string{"y"},
+			fields:   []string{"a", "y", "z", "zz1", "zz2"},
+			want:     []string{"z"},
+		},
+		{
+			name:     "sampling fields win over the priority list",
+			max:      3,
+			sampling: []string{"y"},
+			priority: []string{"x"},
+			fields:   []string{"a", "x", "y", "zz1", "zz2"},
+			want:     []string{"y"},
+		},
+		{
+			name:     "priority list order is kept",
+			max:      4,
+			priority: []string{"c", "a", "b"},
+			fields:   []string{"a", "b", "c", "d", "zz1", "zz2"},
+			want:     []string{"a", "c"},
+		},
+		{
+			name:     "missing prioritized fields are skipped",
+			max:      4,
+			required: []string{"missing"},
+			priority: []string{"gone", "d"},
+			fields:   []string{"a", "b", "c", "d", "zz1", "zz2"},
+			want:     []string{"a", "d"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxFieldsPerEvent = tt.max
+			requiredFields, samplingFields, fieldPriorityList = tt.required, tt.sampling, tt.priority
+
+			data := make(map[string]interface{})
+			for _, f := range tt.fields {
+				data[f] = f
+			}
+			limitFields(data)
+			if tt.max > 0 && len(data) > tt.max {
+				t.Errorf("%d fields left, want at most %d", len(data), tt.max)
+			}
+
+			truncated := len(tt.want) < len(tt.fields)
+			if truncated {
+				if data["honeylog.fields_truncated"] != true {
+					t.Errorf("honeylog.fields_truncated = %v, want true", data["honeylog.fields_truncated"])
+				}
+				if data["honeylog.original_field_count"] != len(tt.fields) {
+					t.Errorf("honeylog.original_field_count = %v, want %d", data["honeylog.original_field_count"], len(tt.fields))
+				}
+				delete(data, "honeylog.fields_truncated")
+				delete(data, "honeylog.original_field_count")
+			}
+
+			var got []string
+			for k := range data {
+				got = append(got, k)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitEventSizeNamesTruncationField(t *testing.T) {
+
+	defer func(size int, policy, casing string) {
+		maxEventSize, oversizeEventPolicy, fieldNameCase = size, policy, casing
+	}(maxEventSize, oversizeEventPolicy, fieldNameCase)
+	maxEventSize, oversizeEventPolicy, fieldNameCase = 64, OversizeTruncate, CasePascal
+
+	data := map[string]interface{}{"a": strings.Repeat("x", 100), "b": "y"}
+	if !limitEventSize(data) {
+		t.Fatal("event was dropped, want it truncated")
+	}
+	if data["Honeylog.SizeTruncated"] != true {
+		t.Errorf("fields after truncation = %v, want Honeylog.SizeTruncated set", data)
+	}
+}
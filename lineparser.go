@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var lineParser *regexp.Regexp
+
+// compileLineParser compiles a LINE_PARSER_REGEX, which needs at least one
+// named capture group to produce any fields.
+func compileLineParser(pattern string) (*regexp.Regexp, error) {
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid line parser regex: %v", err)
+	}
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			return re, nil
+		}
+	}
+	return nil, fmt.Errorf("line parser regex %q has no named capture groups", pattern)
+}
+
+// parseLine adds the named captures of the line parser regex to data if the
+// line matches it, and reports whether it did. Captures named with an int_ or
+// float_ prefix are converted to numbers and stored without the prefix.
+// Groups that captured nothing are left out.
+func parseLine(line []byte, data map[string]interface{}) bool {
+
+	if lineParser == nil {
+		return false
+	}
+	m := lineParser.FindSubmatch(line)
+	if m == nil {
+		return false
+	}
+
+	for i, name := range lineParser.SubexpNames() {
+		if name == "" || len(m[i]) == 0 {
+			continue
+		}
+		value := string(m[i])
+		switch {
+		case strings.HasPrefix(name, "int_"):
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				data[strings.TrimPrefix(name, "int_")] = n
+				continue
+			}
+			data[strings.TrimPrefix(name, "int_")] = value
+		case strings.HasPrefix(name, "float_"):
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				data[strings.TrimPrefix(name, "float_")] = f
+				continue
+			}
+			data[strings.TrimPrefix(name, "float_")] = value
+		default:
+			data[name] = value
+		}
+	}
+	return true
+}
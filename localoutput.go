@@ -0,0 +1,166 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var localOutput *localWriter
+
+var localOutputErrors = metrics.Counter("honeylog_local_output_errors_total", "Kept events that couldn't be written to LOCAL_OUTPUT_FILE.")
+
+// localWriter appends kept events to a local file as newline delimited JSON,
+// which REPLAY_FILE can read back. With compression on, the file is written
+// through a gzip writer. The file is closed and reopened on SIGHUP so it can
+// be rotated by moving it aside.
+type localWriter struct {
+	path  string
+	level int // gzip level, or -2 to write uncompressed
+
+	mu sync.Mutex
+	f  *os.File
+	gz *gzip.Writer
+	w  io.Writer
+}
+
+// newLocalWriter opens path for appending. When compress is set, a .gz
+// extension is added to path if it doesn't have one, and level is the gzip
+// compression level.
+func newLocalWriter(path string, compress bool, level int) (*localWriter, error) {
+
+	l := &localWriter{path: path, level: -2}
+	if compress {
+		if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(path, ".gz") {
+			l.path = path + ".gz"
+		}
+		l.level = level
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file for appending. Gzip output is added as a new gzip
+// member, which readers decompress as part of the same stream. It must be
+// called with mu held, or before the writer is shared.
+func (l *localWriter) open() error {
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	l.w = f
+	if l.level != -2 {
+		l.gz, _ = gzip.NewWriterLevel(f, l.level)
+		l.w = l.gz
+	}
+	return nil
+}
+
+// close flushes and closes the gzip writer, if there is one, and the file.
+// It must be called with mu held.
+func (l *localWriter) close() error {
+
+	var err error
+	if l.gz != nil {
+		err = l.gz.Close()
+		l.gz = nil
+	}
+	if l.f != nil {
+		if cerr := l.f.Close(); err == nil {
+			err = cerr
+		}
+		l.f = nil
+	}
+	l.w = nil
+	return err
+}
+
+// write appends a kept event. The time it happened is added as timestamp,
+// which replays read, unless the event already has a timestamp field.
+func (l *localWriter) write(e keptEvent) {
+
+	if l == nil {
+		return
+	}
+	line := make(map[string]interface{}, len(e.data)+1)
+	for k, v := range e.data {
+		line[k] = v
+	}
+	if _, ok := line["timestamp"]; !ok {
+		ts := e.timestamp
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		line["timestamp"] = ts.UTC().Format(time.RFC3339Nano)
+	}
+	raw, err := json.Marshal(line)
+	if err == nil {
+		raw = append(raw, '\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil && l.w == nil {
+		err = fmt.Errorf("%s is closed", l.path)
+	}
+	if err == nil {
+		_, err = l.w.Write(raw)
+	}
+	if err != nil {
+		localOutputErrors.Inc()
+		fmt.Printf("local output error %v\n", err)
+	}
+}
+
+// watch closes and reopens the file on SIGHUP, after it has been moved aside
+// for rotation.
+func (l *localWriter) watch() {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			l.mu.Lock()
+			if err := l.close(); err != nil {
+				fmt.Printf("error closing %s: %v\n", l.path, err)
+			}
+			if err := l.open(); err != nil {
+				fmt.Printf("error reopening %s: %v\n", l.path, err)
+			}
+			l.mu.Unlock()
+		}
+	}()
+}
+
+// Close flushes anything buffered and closes the file.
+func (l *localWriter) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.close()
+}
+
+// closeLocalOutput closes the local output file, if there is one, once no
+// more events will be kept.
+func closeLocalOutput() {
+	if localOutput == nil {
+		return
+	}
+	if err := localOutput.Close(); err != nil {
+		fmt.Printf("error closing local output: %v\n", err)
+	}
+}
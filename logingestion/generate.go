@@ -0,0 +1,4 @@
+// Package logingestion holds the gRPC service honeylog serves on GRPC_PORT.
+package logingestion
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative logingestion.proto
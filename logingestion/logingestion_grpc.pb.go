@@ -0,0 +1,139 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package logingestion
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// LogIngestionClient is the client API for LogIngestion service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type LogIngestionClient interface {
+	// IngestLogs reads a stream of log records and responds with a summary
+	// once the client closes the stream.
+	IngestLogs(ctx context.Context, opts ...grpc.CallOption) (LogIngestion_IngestLogsClient, error)
+}
+
+type logIngestionClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLogIngestionClient(cc grpc.ClientConnInterface) LogIngestionClient {
+	return &logIngestionClient{cc}
+}
+
+func (c *logIngestionClient) IngestLogs(ctx context.Context, opts ...grpc.CallOption) (LogIngestion_IngestLogsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LogIngestion_ServiceDesc.Streams[0], "/honeylog.logingestion.v1.LogIngestion/IngestLogs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logIngestionIngestLogsClient{stream}
+	return x, nil
+}
+
+type LogIngestion_IngestLogsClient interface {
+	Send(*LogRecord) error
+	CloseAndRecv() (*IngestResponse, error)
+	grpc.ClientStream
+}
+
+type logIngestionIngestLogsClient struct {
+	grpc.ClientStream
+}
+
+func (x *logIngestionIngestLogsClient) Send(m *LogRecord) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *logIngestionIngestLogsClient) CloseAndRecv() (*IngestResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(IngestResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LogIngestionServer is the server API for LogIngestion service.
+// All implementations must embed UnimplementedLogIngestionServer
+// for forward compatibility
+type LogIngestionServer interface {
+	// IngestLogs reads a stream of log records and responds with a summary
+	// once the client closes the stream.
+	IngestLogs(LogIngestion_IngestLogsServer) error
+	mustEmbedUnimplementedLogIngestionServer()
+}
+
+// UnimplementedLogIngestionServer must be embedded to have forward compatible implementations.
+type UnimplementedLogIngestionServer struct {
+}
+
+func (UnimplementedLogIngestionServer) IngestLogs(LogIngestion_IngestLogsServer) error {
+	return status.Errorf(codes.Unimplemented, "method IngestLogs not implemented")
+}
+func (UnimplementedLogIngestionServer) mustEmbedUnimplementedLogIngestionServer() {}
+
+// UnsafeLogIngestionServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LogIngestionServer will
+// result in compilation errors.
+type UnsafeLogIngestionServer interface {
+	mustEmbedUnimplementedLogIngestionServer()
+}
+
+func RegisterLogIngestionServer(s grpc.ServiceRegistrar, srv LogIngestionServer) {
+	s.RegisterService(&LogIngestion_ServiceDesc, srv)
+}
+
+func _LogIngestion_IngestLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LogIngestionServer).IngestLogs(&logIngestionIngestLogsServer{stream})
+}
+
+type LogIngestion_IngestLogsServer interface {
+	SendAndClose(*IngestResponse) error
+	Recv() (*LogRecord, error)
+	grpc.ServerStream
+}
+
+type logIngestionIngestLogsServer struct {
+	grpc.ServerStream
+}
+
+func (x *logIngestionIngestLogsServer) SendAndClose(m *IngestResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *logIngestionIngestLogsServer) Recv() (*LogRecord, error) {
+	m := new(LogRecord)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LogIngestion_ServiceDesc is the grpc.ServiceDesc for LogIngestion service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var LogIngestion_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "honeylog.logingestion.v1.LogIngestion",
+	HandlerType: (*LogIngestionServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "IngestLogs",
+			Handler:       _LogIngestion_IngestLogs_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "logingestion.proto",
+}
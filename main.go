@@ -2,56 +2,340 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"flag"
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/honeycombio/dynsampler-go"
 	"github.com/honeycombio/libhoney-go"
-	"github.com/honeycombio/urlshaper"
+	"github.com/honeycombio/libhoney-go/transmission"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"http-honeylog/logingestion"
 )
 
 const DefaultServerPort = "8080"
 const KeySeperatorChar = "•"
 const MaxLineLength = 65536 // set this to the maximum size we expect log lines to be
 
-var sampler *dynsampler.EMASampleRate
+var sampler *keyLimitedSampler
+var samplerWarmupUntil time.Time
+var batchByRequest bool
+var sendCoalesceSize = 1
 var samplingFields []string
-var urlFields []string
+var samplingHeaderFields []string
+var successStatusCode = http.StatusOK
+var partialSuccessStatusCode = http.StatusOK
 
 func main() {
 
+	flag.Parse()
+
 	// Initialize and configure libhoney
-	libhoney.UserAgentAddition = "http-honeylog/0.1"
-	err := libhoney.Init(libhoney.Config{
-		APIKey:  os.Getenv("HONEYCOMB_API_KEY"),
-		Dataset: os.Getenv("HONEYCOMB_DATASET"),
-	})
+	libhoney.UserAgentAddition = "http-honeylog/" + Version
+	transport, err := libhoneyTransport()
 	if err != nil {
 		fmt.Printf("fatal error initializing libhoney: %v\n", err)
 		os.Exit(100)
 	}
-	libhoney.AddField("event.parser", "http-honeylog/0.1")
-	defer libhoney.Close() // Flush any pending calls to Honeycomb
+	apiKey := os.Getenv("HONEYCOMB_API_KEY")
+	dataset, err := expandDatasetName(os.Getenv("HONEYCOMB_DATASET"))
+	if err != nil {
+		fmt.Printf("fatal error: invalid HONEYCOMB_DATASET template: %v\n", err)
+		os.Exit(142)
+	}
+	datasetTemplate, err = parseDatasetTemplate(os.Getenv("DATASET_TEMPLATE_FIELD"))
+	if err != nil {
+		fmt.Printf("fatal error: invalid DATASET_TEMPLATE_FIELD: %v\n", err)
+		os.Exit(142)
+	}
+	dryRun = envBool("DRY_RUN")
+	warnings, err := checkHoneycombConfig(apiKey, dataset)
+	if err != nil {
+		fmt.Printf("fatal error: %v\n", err)
+		os.Exit(133)
+	}
+	for _, warning := range warnings {
+		fmt.Printf("warning: %v\n", warning)
+	}
+	config := libhoney.Config{
+		APIKey:    apiKey,
+		Dataset:   dataset,
+		Transport: transport,
+	}
+	applyLibhoneyBatching(&config)
+	// print events instead of sending them on a dry run
+	if dryRun {
+		config.Transmission = &transmission.WriterSender{W: os.Stdout}
+		if config.Dataset == "" {
+			config.Dataset = DryRunDataset
+		}
+	}
+	err = initLibhoney(config, time.Duration(envInt("LIBHONEY_INIT_TIMEOUT_SECONDS", DefaultLibhoneyInitTimeoutSeconds))*time.Second)
+	if err != nil {
+		fmt.Printf("fatal error initializing libhoney: %v\n", err)
+		os.Exit(100)
+	}
+	// get the casing to convert field names to
+	fieldNameCase = envString("FIELD_NAME_CASE", CasePreserve)
+	if !validFieldNameCase(fieldNameCase) {
+		fmt.Printf("fatal error: FIELD_NAME_CASE must be preserve, snake_case, camelCase or PascalCase\n")
+		os.Exit(118)
+	}
 
-	// get sampling keys
+	// get the casing incoming field names are normalized to
+	inputFieldCase = envString("INPUT_FIELD_CASE", CasePreserve)
+	if !validInputFieldCase(inputFieldCase) {
+		fmt.Printf("fatal error: INPUT_FIELD_CASE must be preserve, lower, upper or snake\n")
+		os.Exit(118)
+	}
+	if fields := envList("INPUT_FIELD_CASE_EXCLUDE"); len(fields) > 0 {
+		inputFieldCaseExclude = make(map[string]bool, len(fields))
+		for _, f := range fields {
+			inputFieldCaseExclude[f] = true
+		}
+	}
+
+	// get how keys repeated within a JSON event are handled
+	duplicateKeyPolicy = envString("DUPLICATE_KEY_POLICY", DuplicateKeyLast)
+	if !validDuplicateKeyPolicy(duplicateKeyPolicy) {
+		fmt.Printf("fatal error: DUPLICATE_KEY_POLICY must be last, first, array or error\n")
+		os.Exit(144)
+	}
+
+	// get the prefix of the metadata fields added to every event
+	fieldNamespace = envString("HONEYLOG_FIELD_NAMESPACE", DefaultFieldNamespace)
+
+	libhoney.AddField(metaField("parser"), "http-honeylog/"+Version)
+	flushTimeout := time.Duration(envInt("LIBHONEY_FLUSH_TIMEOUT_SECONDS", DefaultLibhoneyFlushTimeoutSeconds)) * time.Second
+
+	// identify this instance on every event if asked to
+	if envBool("INJECT_HOSTNAME") {
+		hostname, err := os.Hostname()
+		if err != nil {
+			fmt.Printf("fatal error getting hostname: %v\n", err)
+			os.Exit(109)
+		}
+		libhoney.AddField(fieldName(envString("HOSTNAME_FIELD", "honeylog.hostname")), hostname)
+	}
+	if envBool("INJECT_HOST_IP") {
+		ip, err := primaryHostIP()
+		if err != nil {
+			fmt.Printf("fatal error getting host IP: %v\n", err)
+			os.Exit(109)
+		}
+		libhoney.AddField(fieldName(envString("HOST_IP_FIELD", "honeylog.host_ip")), ip)
+	}
+
+	// add the labels of the pod or container we're running in if asked to
+	labels, err := instanceLabels()
+	if err != nil {
+		fmt.Printf("fatal error reading labels: %v\n", err)
+		os.Exit(116)
+	}
+	for name, value := range labels {
+		libhoney.AddField(fieldName(name), value)
+	}
+
+	// get sampling keys, or key events by their schema instead
 	skeys := os.Getenv("HONEYCOMB_SAMPLING_FIELDS")
-	if len(skeys) == 0 {
+	structuralSampling = envBool("STRUCTURAL_SAMPLING")
+	switch {
+	case structuralSampling && len(skeys) > 0:
+		fmt.Printf("fatal error: set only one of HONEYCOMB_SAMPLING_FIELDS and STRUCTURAL_SAMPLING\n")
+		os.Exit(101)
+	case structuralSampling:
+	case len(skeys) == 0:
 		fmt.Printf("fatal error: HONEYCOMB_SAMPLING_FIELDS environment variable is not set\n")
 		os.Exit(101)
+	default:
+		samplingFields = strings.Split(skeys, ",")
+		for i, field := range samplingFields {
+			samplingFields[i] = fieldName(field)
+		}
+	}
+
+	// get numeric fields to aggregate across events sharing a sampling key
+	aggregateFields = envList("AGGREGATE_FIELDS")
+	for i, field := range aggregateFields {
+		aggregateFields[i] = fieldName(field)
+	}
+
+	// get request headers to be prepended to the sampling key
+	samplingHeaderFields = envList("SAMPLING_HEADER_FIELDS")
+	normalizeSamplingKeys = envBool("NORMALIZE_SAMPLING_KEYS")
+	headerValueSeparator = envString("HEADER_VALUE_SEPARATOR", ",")
+	headerMultiValuePolicy = strings.ToLower(envString("HEADER_MULTI_VALUE_POLICY", HeaderPolicyJoin))
+	if !validHeaderPolicy(headerMultiValuePolicy) {
+		fmt.Printf("fatal error: HEADER_MULTI_VALUE_POLICY must be first, last, all or join\n")
+		os.Exit(132)
 	}
-	samplingFields = strings.Split(skeys, ",")
 
-	// get URL fields to be parsed
-	urlFields = strings.Split(os.Getenv("HONEYCOMB_URL_FIELDS"), ",")
+	// get request headers to be added to every event as fields
+	forwardRequestHeaders = envList("FORWARD_REQUEST_HEADERS")
+	headerFieldPrefix = envString("HEADER_FIELD_PREFIX", headerFieldPrefix)
+
+	// get rules for sending events to more than one dataset
+	if path := os.Getenv("FAN_OUT_RULES"); path != "" {
+		fanOutRules, err = loadFanOutRules(path)
+		if err != nil {
+			fmt.Printf("fatal error loading fan out rules: %v\n", err)
+			os.Exit(125)
+		}
+	}
+
+	// get rules routing, tagging, sampling and dropping events by their fields
+	if path := os.Getenv("ROUTING_RULES_FILE"); path != "" {
+		routingRules, err = loadRuleEngine(path)
+		if err != nil {
+			fmt.Printf("fatal error loading routing rules: %v\n", err)
+			os.Exit(138)
+		}
+	}
+
+	// get fields whose values are always replaced
+	fieldOverrides, err = parseFieldOverrides(envList("FIELD_OVERRIDES"))
+	if err != nil {
+		fmt.Printf("fatal error: %v\n", err)
+		os.Exit(120)
+	}
+
+	// get where tags embedded in log messages are extracted from
+	messageTagField = os.Getenv("MESSAGE_TAG_FIELD")
+	if messageTagField != "" {
+		messageTagPattern, err = compileMessageTagPattern(envString("MESSAGE_TAG_PATTERN", DefaultMessageTagPattern))
+		if err != nil {
+			fmt.Printf("fatal error: %v\n", err)
+			os.Exit(129)
+		}
+		stripExtractedTags = envBool("STRIP_EXTRACTED_TAGS")
+	}
+
+	// get the pattern for lines in a custom format
+	if pattern := os.Getenv("LINE_PARSER_REGEX"); pattern != "" {
+		lineParser, err = compileLineParser(pattern)
+		if err != nil {
+			fmt.Printf("fatal error: %v\n", err)
+			os.Exit(134)
+		}
+	}
+
+	// get templates for derived fields
+	if path := os.Getenv("FIELD_TEMPLATES"); path != "" {
+		fieldTemplates, err = loadFieldTemplates(path)
+		if err != nil {
+			fmt.Printf("fatal error loading field templates: %v\n", err)
+			os.Exit(112)
+		}
+	}
+
+	// get field limits, and which fields to favour when events are pruned
+	maxFieldsPerEvent = envInt("MAX_FIELDS_PER_EVENT", 0)
+	requiredFields = envList("REQUIRED_FIELDS")
+	fieldPriorityList = envList("FIELD_PRIORITY_LIST")
+	sortFields = envBool("SORT_FIELDS")
+	fieldMaxLength = envInt("FIELD_MAX_LENGTH", 0)
+	fieldMaxLengthOverrides, err = parseFieldMaxLengthOverrides(os.Getenv("FIELD_MAX_LENGTH_OVERRIDES"))
+	if err != nil {
+		fmt.Printf("fatal error: invalid FIELD_MAX_LENGTH_OVERRIDES: %v\n", err)
+		os.Exit(126)
+	}
+	eventProcessingTimeout = time.Duration(envInt("EVENT_PROCESSING_TIMEOUT_MS", 0)) * time.Millisecond
+	maxEventSize = envInt("MAX_EVENT_SIZE_BYTES", DefaultMaxEventSizeBytes)
+	oversizeEventPolicy = envString("OVERSIZE_EVENT_POLICY", OversizeTruncate)
+	if oversizeEventPolicy != OversizeTruncate && oversizeEventPolicy != OversizeDrop {
+		fmt.Printf("fatal error: OVERSIZE_EVENT_POLICY must be truncate or drop\n")
+		os.Exit(140)
+	}
+
+	// get multipliers of the sampler's rate by HTTP method, or another field
+	samplingMethodRates, err = parseSamplingMethodRates(envList("SAMPLING_METHOD_RATES"))
+	if err != nil {
+		fmt.Printf("fatal error: %v\n", err)
+		os.Exit(141)
+	}
+	samplingMethodField = fieldName(envString("SAMPLING_METHOD_FIELD", envString("HTTP_METHOD_FIELD", DefaultSamplingMethodField)))
+
+	// get fields whose values are always booleans
+	base64Fields = envList("BASE64_DECODE_FIELDS")
+	if envExpandFields = envList("ENV_EXPAND_FIELDS"); len(envExpandFields) > 0 {
+		envExpandVars, err = loadEnvExpandVars(envList("ENV_EXPAND_VARS"))
+		if err != nil {
+			fmt.Printf("fatal error: %v\n", err)
+			os.Exit(150)
+		}
+	}
+	postSendHookTimeout = time.Duration(envInt("POST_SEND_HOOK_TIMEOUT_MS", DefaultPostSendHookTimeoutMS)) * time.Millisecond
+	boolFields = envList("BOOL_FIELDS")
+	boolFieldErrorPolicy = envString("BOOL_FIELD_ERROR_POLICY", BoolErrorKeepOriginal)
+	switch boolFieldErrorPolicy {
+	case BoolErrorDropEvent, BoolErrorDropField, BoolErrorKeepOriginal:
+	default:
+		fmt.Printf("fatal error: BOOL_FIELD_ERROR_POLICY must be drop_event, drop_field or keep_original\n")
+		os.Exit(143)
+	}
+
+	// get the field and values marking events that are always kept
+	priorityBoostField = fieldName(os.Getenv("PRIORITY_BOOST_FIELD"))
+	if values := envList("PRIORITY_BOOST_VALUES"); len(values) > 0 {
+		priorityBoostValues = make(map[string]bool, len(values))
+		for _, v := range values {
+			priorityBoostValues[v] = true
+		}
+	}
+	if raw := os.Getenv("PRIORITY_BOOST_FACTOR"); raw != "" {
+		priorityBoostFactor, err = strconv.ParseFloat(raw, 64)
+		if err != nil || priorityBoostFactor <= 0 {
+			fmt.Printf("fatal error: PRIORITY_BOOST_FACTOR must be a positive number\n")
+			os.Exit(141)
+		}
+	}
+
+	// get which fields have the types of their values annotated
+	annotateFieldTypes = envBool("ANNOTATE_FIELD_TYPES")
+	typeAnnotationSuffix = envString("TYPE_ANNOTATION_PREFIX", DefaultTypeAnnotationSuffix)
+	if fields := envList("ANNOTATE_FIELDS"); len(fields) > 0 {
+		annotatedFields = make(map[string]bool, len(fields))
+		for _, f := range fields {
+			annotatedFields[f] = true
+		}
+	}
+
+	// get URL fields to be parsed, and build their parsers up front
+	urlOptions, err := loadURLShaperOptions(os.Getenv("URL_SHAPER_CONFIG_FILE"), os.Getenv("URL_SHAPER_OPTIONS"))
+	if err != nil {
+		fmt.Printf("fatal error configuring URL fields: %v\n", err)
+		os.Exit(111)
+	}
+	urlShapers, err = buildURLShapers(envList("HONEYCOMB_URL_FIELDS"), urlOptions)
+	if err != nil {
+		fmt.Printf("fatal error configuring URL fields: %v\n", err)
+		os.Exit(111)
+	}
+	urlStripFragment = envBoolDefault("URL_STRIP_FRAGMENT", true)
+	urlPreserveFragment = envBool("URL_PRESERVE_FRAGMENT")
+	urlQuerySeparator = envString("URL_QUERY_SEPARATOR", "ampersand")
+	switch urlQuerySeparator {
+	case "ampersand", "semicolon", "auto":
+	default:
+		fmt.Printf("fatal error: URL_QUERY_SEPARATOR must be ampersand, semicolon or auto\n")
+		os.Exit(111)
+	}
 
 	// Create and start sampler
 	rate, err := strconv.Atoi(os.Getenv("HONEYCOMB_SAMPLE_RATE"))
@@ -59,104 +343,1085 @@ func main() {
 		rate = 1
 	}
 	// Can also specify other options here for the EMADynamicSampler if desired
-	sampler = &dynsampler.EMASampleRate{
+	maxSamplerKeys := envInt("MAX_SAMPLER_KEYS", 0)
+	ema := &dynsampler.EMASampleRate{
 		GoalSampleRate: rate,
+		MaxKeys:        maxSamplerKeys,
 	}
-	err = sampler.Start()
+	err = ema.Start()
 	if err != nil {
 		fmt.Printf("fatal error starting sampler: %v\n", err)
 		os.Exit(102)
 	}
+	envGoalSampleRate = ema.GoalSampleRate
+	sampler, err = newKeyLimitedSampler(ema, maxSamplerKeys, os.Getenv("SAMPLER_KEY_EVICTION"))
+	if err != nil {
+		fmt.Printf("fatal error starting sampler: %v\n", err)
+		os.Exit(102)
+	}
+	minSampleRate = envInt("MIN_SAMPLE_RATE", 1)
+	maxSampleRate = envInt("MAX_SAMPLE_RATE", 0)
+	if minSampleRate < 1 || maxSampleRate < 0 || (maxSampleRate > 0 && maxSampleRate < minSampleRate) {
+		fmt.Printf("fatal error: MIN_SAMPLE_RATE must be at least 1, and MAX_SAMPLE_RATE 0 or at least MIN_SAMPLE_RATE\n")
+		os.Exit(102)
+	}
+	keyGoalRates, err = parseKeyGoalRates(os.Getenv("SAMPLING_KEY_GOAL_RATES"), maxSamplerKeys)
+	if err != nil {
+		fmt.Printf("fatal error: invalid SAMPLING_KEY_GOAL_RATES: %v\n", err)
+		os.Exit(102)
+	}
+	metrics.Gauge("honeylog_sampler_active_keys", "Number of sampling keys tracked by the sampler.", func() float64 {
+		return float64(sampler.ActiveKeys())
+	})
+	stats.Register("sampler_active_keys", func() interface{} {
+		return sampler.ActiveKeys()
+	})
+
+	// Optionally drop events repeated within a window, such as shipper retries
+	if fields := envList("DEDUP_FIELDS"); len(fields) > 0 {
+		window := envInt("DEDUP_WINDOW_SECONDS", DefaultDedupWindowSeconds)
+		if window <= 0 || window > MaxDedupWindowSeconds {
+			fmt.Printf("fatal error: DEDUP_WINDOW_SECONDS must be between 1 and %d\n", MaxDedupWindowSeconds)
+			os.Exit(130)
+		}
+		maxEntries := envInt("DEDUP_MAX_ENTRIES", DefaultDedupMaxEntries)
+		if maxEntries <= 0 {
+			maxEntries = DefaultDedupMaxEntries
+		}
+		dedup = newDedupCache(fields, time.Duration(window)*time.Second, maxEntries)
+		stats.Register("dedup_entries", func() interface{} {
+			return dedup.Len()
+		})
+	}
+
+	// Optionally record configuration reloads that change anything
+	if path := os.Getenv("CONFIG_AUDIT_LOG_FILE"); path != "" {
+		configAudit, err = openAuditLog(path)
+		if err != nil {
+			fmt.Printf("fatal error opening config audit log: %v\n", err)
+			os.Exit(127)
+		}
+	}
+
+	// load operator overrides of the sampler, and keep them up to date
+	if path := os.Getenv("SAMPLING_OVERRIDE_FILE"); path != "" {
+		err = watchSamplingOverrides(path)
+		if err != nil {
+			fmt.Printf("fatal error loading sampling overrides: %v\n", err)
+			os.Exit(113)
+		}
+	}
+
+	// Optionally load sampling configuration from a database, refreshed
+	// periodically and on SIGHUP
+	if dsn := os.Getenv("SAMPLING_CONFIG_DB_URL"); dsn != "" {
+		configDB, err := newSamplingConfigDB(dsn)
+		if err != nil {
+			fmt.Printf("fatal error configuring sampling config database: %v\n", err)
+			os.Exit(124)
+		}
+		if err := configDB.load(""); err != nil {
+			fmt.Printf("error loading sampling config from database, using environment config: %v\n", err)
+		}
+		refresh := envInt("SAMPLING_DB_REFRESH_SECONDS", DefaultSamplingDBRefreshSeconds)
+		if refresh < 1 {
+			refresh = DefaultSamplingDBRefreshSeconds
+		}
+		configDB.watch(time.Duration(refresh) * time.Second)
+	}
+	if os.Getenv("SAMPLING_OVERRIDE_FILE") != "" || os.Getenv("SAMPLING_CONFIG_DB_URL") != "" {
+		stats.Register("sampling_overrides", func() interface{} {
+			return activeSamplingOverrides()
+		})
+	}
+
+	// keep everything while the sampler learns the traffic, if asked to
+	if warmup := envInt("SAMPLER_WARMUP_SECONDS", 0); warmup > 0 {
+		samplerWarmupUntil = time.Now().Add(time.Duration(warmup) * time.Second)
+	}
+
+	// Optionally forward events to another honeylog instance instead of Honeycomb
+	upstream, err = newUpstreamForwarder()
+	if err != nil {
+		fmt.Printf("fatal error configuring upstream: %v\n", err)
+		os.Exit(107)
+	}
+
+	// Optionally keep a local copy of kept events, which can be replayed. A
+	// replay doesn't write one, since it's usually replaying that very file.
+	if path := os.Getenv("LOCAL_OUTPUT_FILE"); path != "" && replayPath() == "" {
+		localOutput, err = newLocalWriter(path, envBool("LOCAL_OUTPUT_COMPRESS"), envInt("LOCAL_OUTPUT_COMPRESS_LEVEL", gzip.DefaultCompression))
+		if err != nil {
+			fmt.Printf("fatal error opening local output: %v\n", err)
+			os.Exit(149)
+		}
+		localOutput.watch()
+	}
+
+	// Optionally tag events with fields chosen by the client's IP range
+	if path := os.Getenv("IP_RANGE_FIELDS"); path != "" {
+		ranges, err := loadIPRanges(path)
+		if err != nil {
+			fmt.Printf("fatal error loading IP range fields: %v\n", err)
+			os.Exit(137)
+		}
+		ipRanges.Store(ranges)
+		watchIPRanges(path)
+	}
+
+	// Optionally rename fields of events from before a service renamed them
+	if path := os.Getenv("FIELD_MIGRATIONS"); path != "" {
+		fieldMigrations, err = loadFieldMigrations(path)
+		if err != nil {
+			fmt.Printf("fatal error loading field migrations: %v\n", err)
+			os.Exit(147)
+		}
+	}
+
+	// Optionally mask sensitive parts of field values
+	if path := os.Getenv("MASK_PATTERNS"); path != "" {
+		maskRules, err = loadMaskRules(path)
+		if err != nil {
+			fmt.Printf("fatal error loading mask patterns: %v\n", err)
+			os.Exit(148)
+		}
+	}
+
+	// Optionally cap the events kept for each API key
+	if path := os.Getenv("QUOTA_RULES_FILE"); path != "" {
+		quotas, err = loadQuotaRules(path, apiKey, envInt("QUOTA_MAX_KEYS", DefaultQuotaMaxKeys))
+		if err != nil {
+			fmt.Printf("fatal error loading quota rules: %v\n", err)
+			os.Exit(146)
+		}
+		stats.Register("quota_rules", func() interface{} {
+			return quotas.ruleStats(time.Now())
+		})
+	}
+
+	// Optionally enrich events with data looked up in Redis
+	enricher, err = newRedisEnricher()
+	if err != nil {
+		fmt.Printf("fatal error configuring redis enrichment: %v\n", err)
+		os.Exit(135)
+	}
+	if enricher != nil {
+		go enricher.expireLoop()
+	}
+
+	// Optionally copy every request to a mirror, such as a staging instance
+	mirror, err = newMirrorSender()
+	if err != nil {
+		fmt.Printf("fatal error configuring mirror: %v\n", err)
+		os.Exit(119)
+	}
+
+	// libhoney already batches events from every request into each HTTP call
+	if os.Getenv("BATCH_COALESCE_MS") != "" {
+		fmt.Printf("warning: BATCH_COALESCE_MS is no longer supported and is ignored; libhoney batches sends, tuned with LIBHONEY_MAX_BATCH_SIZE and LIBHONEY_SEND_FREQUENCY_MS\n")
+	}
+
+	// Optionally merge counter events from all requests into periodic totals
+	if groupBy := envList("AGGREGATE_COUNTER_FIELDS"); len(groupBy) > 0 {
+		sum := envList("AGGREGATE_SUM_FIELDS")
+		for i, field := range groupBy {
+			groupBy[i] = fieldName(field)
+		}
+		for i, field := range sum {
+			sum[i] = fieldName(field)
+		}
+		interval := envInt("AGGREGATE_FLUSH_INTERVAL_SECONDS", DefaultAggregateFlushIntervalSeconds)
+		if interval <= 0 {
+			interval = DefaultAggregateFlushIntervalSeconds
+		}
+		counters = newCounterAggregator(groupBy, sum, time.Duration(interval)*time.Second)
+	}
+
+	// Optionally hold each request's kept events to send together at its end,
+	// or in batches of a given size
+	batchByRequest = envBool("BATCH_BY_REQUEST")
+	sendCoalesceSize = envInt("SEND_COALESCE_SIZE", 1)
+
+	// get how fields honeylog adds resolve collisions with existing ones
+	fieldCollisionPolicy = envString("FIELD_COLLISION_POLICY", CollisionOverwrite)
+	if !validCollisionPolicy(fieldCollisionPolicy) {
+		fmt.Printf("fatal error: FIELD_COLLISION_POLICY must be overwrite, keep_original, suffix or error\n")
+		os.Exit(139)
+	}
+
+	// get how float values are cleaned up
+	nanPolicy = envString("NAN_POLICY", NaNPolicyNull)
+	if !validNaNPolicy(nanPolicy) {
+		fmt.Printf("fatal error: NAN_POLICY must be null, zero or string\n")
+		os.Exit(128)
+	}
+	floatPrecision = envInt("FLOAT_PRECISION", DefaultFloatPrecision)
+	floatToIntIfWhole = envBool("FLOAT_TO_INT_IF_WHOLE")
+	if fields := envList("NUMERIC_PRECISION_FIELDS"); len(fields) > 0 {
+		numericPrecisionFields = make(map[string]bool, len(fields))
+		for _, f := range fields {
+			numericPrecisionFields[f] = true
+		}
+		numericPrecisionDigits = envInt("NUMERIC_PRECISION_DIGITS", DefaultNumericPrecisionDigits)
+		if numericPrecisionDigits <= 0 {
+			numericPrecisionDigits = DefaultNumericPrecisionDigits
+		}
+	}
+
+	correlationIDHeader = envString("CORRELATION_ID_HEADER", correlationIDHeader)
+	vectorCompat = envBool("VECTOR_COMPAT")
+	beelineCompat = envBool("BEELINE_COMPAT")
+	fluentdCompat = envBool("FLUENTD_COMPAT")
+	streamingDecode = envBool("STREAMING_DECODE")
+
+	// get the field holding when each event happened
+	timestampField = os.Getenv("TIMESTAMP_FIELD")
+	timestampPrecision = envString("TIMESTAMP_PRECISION", PrecisionAuto)
+	if !validTimestampPrecision(timestampPrecision) {
+		fmt.Printf("fatal error: TIMESTAMP_PRECISION must be auto, s, ms or us\n")
+		os.Exit(121)
+	}
+	timestampPrecisionWarning = envBool("TIMESTAMP_PRECISION_WARNING")
+
+	// get the format of request bodies, or have it detected per request
+	inputFormat = strings.ToLower(envString("INPUT_FORMAT", FormatJSON))
+	if !validInputFormat(inputFormat) {
+		fmt.Printf("fatal error: INPUT_FORMAT must be json, logfmt, msgpack, clf, combined or w3c_elf\n")
+		os.Exit(117)
+	}
+	autoDetectFormat = envBool("AUTO_DETECT_FORMAT")
+	autoDetectBytes = envInt("AUTO_DETECT_BYTES", DefaultAutoDetectBytes)
+	if autoDetectBytes < 1 {
+		autoDetectBytes = DefaultAutoDetectBytes
+	}
+
+	// get the status codes to acknowledge requests with
+	successStatusCode = envInt("SUCCESS_STATUS_CODE", http.StatusOK)
+	switch successStatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+	default:
+		fmt.Printf("fatal error: SUCCESS_STATUS_CODE must be 200, 201 or 204\n")
+		os.Exit(108)
+	}
+	partialSuccessStatusCode = envInt("PARTIAL_SUCCESS_STATUS_CODE", http.StatusOK)
+	switch partialSuccessStatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent, http.StatusPartialContent:
+	default:
+		fmt.Printf("fatal error: PARTIAL_SUCCESS_STATUS_CODE must be 200, 201, 204 or 206\n")
+		os.Exit(108)
+	}
+
+	// Optionally exit when too many events are failing, to be restarted by a supervisor
+	if threshold, _ := strconv.ParseFloat(os.Getenv("ERROR_RATE_EXIT_THRESHOLD"), 64); threshold > 0 {
+		window := envInt("ERROR_RATE_WINDOW_SECONDS", 60)
+		if window < 1 {
+			window = 60
+		}
+		errorRate = &errorRateMonitor{
+			threshold: threshold,
+			cooldown:  time.Duration(envInt("ERROR_RATE_EXIT_COOLDOWN_SECONDS", 0)) * time.Second,
+			window:    newSlidingWindow(window),
+		}
+	}
+
+	// Optionally make sure Honeycomb accepts our events before taking any
+	if envBool("PREFLIGHT_CHECK") {
+		timeout := time.Duration(envInt("PREFLIGHT_TIMEOUT_SECONDS", 10)) * time.Second
+		if err := preflightCheck(timeout); err != nil {
+			if fatal, perr := strconv.ParseBool(os.Getenv("PREFLIGHT_CHECK_FATAL")); perr != nil || fatal {
+				fmt.Printf("fatal error: %v\n", err)
+				os.Exit(114)
+			}
+			fmt.Printf("warning: %v\n", err)
+		} else {
+			fmt.Printf("Preflight check succeeded\n")
+		}
+	}
+
+	// Replay an archived file of events instead of serving, if asked to
+	if path := replayPath(); path != "" {
+		window, err := newReplayWindow()
+		if err != nil {
+			fmt.Printf("fatal error: %v\n", err)
+			os.Exit(115)
+		}
+		if err := replayFile(path, window); err != nil {
+			fmt.Printf("fatal error replaying %s: %v\n", path, err)
+			os.Exit(115)
+		}
+		if counters != nil {
+			counters.Stop()
+		}
+		closeLocalOutput()
+		if !closeLibhoney(flushTimeout) {
+			fmt.Printf("warning: timed out after %v sending replayed events to Honeycomb, some may be lost\n", flushTimeout)
+			os.Exit(145)
+		}
+		return
+	}
+
+	// Optionally queue request bodies to be processed in the background
+	switch backend := envString("QUEUE_BACKEND", ""); backend {
+	case "":
+	case "memory":
+		size := envInt("QUEUE_SIZE", DefaultQueueSize)
+		if size < 1 {
+			size = DefaultQueueSize
+		}
+		queue = newMemoryQueue(size)
+	case "disk":
+		dir := os.Getenv("QUEUE_DIR")
+		if dir == "" {
+			fmt.Printf("fatal error: QUEUE_DIR must be set for the disk queue\n")
+			os.Exit(123)
+		}
+		queue, err = newDiskQueue(dir, int64(envInt("MAX_QUEUE_DISK_BYTES", 0)))
+		if err != nil {
+			fmt.Printf("fatal error opening queue: %v\n", err)
+			os.Exit(123)
+		}
+	default:
+		fmt.Printf("fatal error: QUEUE_BACKEND must be memory or disk\n")
+		os.Exit(123)
+	}
+	metrics.Gauge("honeylog_queue_depth", "Request bodies waiting to be processed.", func() float64 {
+		if queue == nil {
+			return 0
+		}
+		return float64(queue.depth())
+	})
+
+	// Optionally send a heartbeat event on a fixed schedule
+	var beat *heartbeat
+	if interval := envInt("HEARTBEAT_INTERVAL_SECONDS", 0); interval > 0 {
+		beat = newHeartbeat(time.Duration(interval) * time.Second)
+	}
 
 	// Create HTTP server and primary handler
 	serverPort := os.Getenv("SERVER_PORT")
 	if serverPort == "" {
 		serverPort = DefaultServerPort
 	}
-	server := &http.Server{Addr: ":" + serverPort}
+	listenAddr := os.Getenv("SERVER_LISTEN_ADDR")
+	server := &http.Server{
+		Addr:           net.JoinHostPort(listenAddr, serverPort),
+		MaxHeaderBytes: envInt("SERVER_MAX_HEADER_BYTES", 0),
+		IdleTimeout:    time.Duration(envInt("SERVER_IDLE_TIMEOUT_SECONDS", 0)) * time.Second,
+		ConnState:      trackConnState,
+	}
+	metrics.Gauge("honeylog_active_connections", "Open client connections to the HTTP server.", func() float64 {
+		return float64(atomic.LoadInt64(&activeConnections))
+	})
+	stats.Register("in_flight_requests", func() interface{} {
+		return atomic.LoadInt64(&inFlightRequests)
+	})
+
 	http.HandleFunc("/", readNewData)
+	http.HandleFunc("/metrics", serveMetrics)
+	http.HandleFunc("/stats", serveStats)
+	http.HandleFunc("/stream", serveStream)
+	outputWrapMetadata = envBool("OUTPUT_WRAP_METADATA")
+	stats.Register("stream_clients", func() interface{} {
+		return streams.Clients()
+	})
+	if maxBytes := envInt("BATCH_UPLOAD_MAX_BYTES", 0); maxBytes > 0 {
+		batchUploadMaxBytes = int64(maxBytes)
+	}
+	http.HandleFunc("/batch-upload", readBatchUpload)
+	if envBool("OTLP_COMPAT") {
+		if maxBytes := envInt("OTLP_MAX_BODY_BYTES", 0); maxBytes > 0 {
+			otlpMaxBodyBytes = int64(maxBytes)
+		}
+		http.HandleFunc("/v1/logs", readOTLPLogs)
+	}
+	if ddEndpoint := strings.TrimSuffix(os.Getenv("DD_COMPAT_ENDPOINT"), "/"); ddEndpoint != "" {
+		http.HandleFunc(ddEndpoint+"/", readDatadogData)
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		fmt.Printf("error on server listen: %v\n", err)
+		os.Exit(103)
+	}
+	if maxConns := envInt("SERVER_MAX_CONNS", 0); maxConns > 0 {
+		overflow := envString("SERVER_CONN_OVERFLOW", "reject")
+		if overflow != "reject" && overflow != "queue" {
+			fmt.Printf("fatal error: SERVER_CONN_OVERFLOW must be reject or queue\n")
+			os.Exit(103)
+		}
+		listener = limitListener(listener, maxConns, overflow)
+	}
+
+	// Optionally require an ingest token, except on paths that may bypass it
+	var handler http.Handler = http.DefaultServeMux
+	ingestToken := os.Getenv("HONEYCOMB_INGEST_TOKEN")
+	if ingestToken != "" {
+		handler = requireIngestToken(handler, ingestToken, envList("AUTH_BYPASS_PATHS"))
+	}
+	// In test mode, let requests ask for their responses to be delayed
+	if envBool("TEST_MODE") {
+		fmt.Printf("warning: TEST_MODE is on, requests may delay their responses\n")
+		handler = delayResponses(handler, envString("TEST_RESPONSE_DELAY_HEADER", DefaultTestResponseDelayHeader))
+	}
+	server.Handler = handler
+
+	// Optionally serve HTTPS, requiring client certificates if given CAs
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		fmt.Printf("fatal error configuring TLS: %v\n", err)
+		os.Exit(136)
+	}
+	if tlsConfig != nil {
+		server.TLSConfig = tlsConfig
+		if tlsConfig.ClientCAs != nil {
+			server.Handler = requireClientCert(handler, tlsConfig.ClientCAs, envList("TLS_CLIENT_CN_ALLOWLIST"))
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 	go func() {
-		fmt.Printf("Starting server on port %s\n", serverPort)
-		if err := server.ListenAndServe(); err != nil {
-			fmt.Printf("error on server listen and serve: %v\n", err)
+		fmt.Printf("Starting server on %s\n", server.Addr)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("error on server serve: %v\n", err)
 			os.Exit(103)
 		}
 	}()
 
+	// Optionally accept log records over gRPC
+	var grpcServer *grpc.Server
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		grpcAddr := net.JoinHostPort(listenAddr, grpcPort)
+		listener, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			fmt.Printf("fatal error listening for gRPC: %v\n", err)
+			os.Exit(122)
+		}
+		// gRPC is served with the same certificate, client and token checks
+		// as HTTP
+		var grpcOpts []grpc.ServerOption
+		var interceptors []grpc.StreamServerInterceptor
+		if tlsConfig != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+			if tlsConfig.ClientCAs != nil {
+				interceptors = append(interceptors, requireClientCertStream(tlsConfig.ClientCAs, envList("TLS_CLIENT_CN_ALLOWLIST")))
+			}
+		}
+		if ingestToken != "" {
+			interceptors = append(interceptors, requireIngestTokenStream(ingestToken))
+		}
+		grpcOpts = append(grpcOpts, grpc.ChainStreamInterceptor(interceptors...))
+		grpcServer = grpc.NewServer(grpcOpts...)
+		logingestion.RegisterLogIngestionServer(grpcServer, &grpcIngestServer{})
+		go func() {
+			fmt.Printf("Starting gRPC server on %s\n", grpcAddr)
+			if err := grpcServer.Serve(listener); err != nil {
+				fmt.Printf("error on gRPC serve: %v\n", err)
+				os.Exit(122)
+			}
+		}()
+	}
+
+	// Optionally consume events from a Kafka topic as well
+	kafkaInput, err := newKafkaConsumer()
+	if err != nil {
+		fmt.Printf("fatal error configuring kafka input: %v\n", err)
+		os.Exit(131)
+	}
+	if kafkaInput != nil {
+		fmt.Printf("Consuming from kafka topic %s\n", os.Getenv("KAFKA_INPUT_TOPIC"))
+		kafkaInput.Start()
+	}
+
+	// Optionally listen on a Unix domain socket for local clients. Socket
+	// connections carry no TLS, so their server gets the handler without
+	// the client certificate check
+	var socketServer *http.Server
+	socketPath := os.Getenv("UNIX_SOCKET_PATH")
+	if socketPath != "" {
+		mode, err := strconv.ParseUint(os.Getenv("UNIX_SOCKET_MODE"), 8, 32)
+		if err != nil {
+			mode = DefaultUnixSocketMode
+		}
+		listener, err := listenUnixSocket(socketPath, os.FileMode(mode))
+		if err != nil {
+			fmt.Printf("fatal error listening on unix socket: %v\n", err)
+			os.Exit(105)
+		}
+		socketServer = &http.Server{
+			Handler:        handler,
+			MaxHeaderBytes: server.MaxHeaderBytes,
+			IdleTimeout:    server.IdleTimeout,
+			ConnState:      trackConnState,
+		}
+		go func() {
+			fmt.Printf("Starting server on unix socket %s\n", socketPath)
+			if err := socketServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+				fmt.Printf("error on server serve for unix socket: %v\n", err)
+				os.Exit(106)
+			}
+		}()
+	}
+
 	// set up signal capturing
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
 
 	// Waiting for SIGINT (kill -2)
 	<-stop
-	libhoney.Flush()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+	if kafkaInput != nil {
+		kafkaInput.Stop()
+	}
+
+	// stop taking new requests, and give those in flight a chance to finish
+	// before their events are flushed
+	drainMaxWait := time.Duration(envInt("DRAIN_MAX_WAIT_SECONDS", DefaultDrainMaxWaitSeconds)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), drainMaxWait)
 	defer cancel()
-	if err := server.Shutdown(ctx); err != nil {
+	shutdownErr := make(chan error, 1)
+	go func() {
+		err := server.Shutdown(ctx)
+		if socketServer != nil {
+			if socketErr := socketServer.Shutdown(ctx); err == nil {
+				err = socketErr
+			}
+		}
+		shutdownErr <- err
+	}()
+	if n := waitForInFlight(drainMaxWait); n > 0 {
+		fmt.Printf("%d requests still in flight after %v, their events may be lost\n", n, drainMaxWait)
+	}
+
+	if beat != nil {
+		beat.Stop()
+	}
+	if queue != nil {
+		queue.Stop()
+	}
+	if counters != nil {
+		counters.Stop()
+	}
+	if upstream != nil {
+		upstream.Stop()
+	}
+	closeLocalOutput()
+
+	// send what libhoney still holds, but don't hang on an unreachable API
+	if !closeLibhoney(flushTimeout) {
+		fmt.Printf("warning: timed out after %v flushing events to Honeycomb, some may be lost\n", flushTimeout)
+		os.Exit(145)
+	}
+	if err := <-shutdownErr; err != nil {
 		fmt.Printf("error shutting down server: %v\n", err)
 		os.Exit(104)
 	}
+	if socketPath != "" {
+		removeUnixSocket(socketPath)
+	}
 }
 
 func readNewData(w http.ResponseWriter, r *http.Request) {
 
-	startTime := time.Now()
+	defer trackInFlight()()
+	w.Header().Set("X-Request-ID", requestID(r))
+	if mirror != nil {
+		if err := mirror.tee(r); err != nil {
+			fmt.Printf("[%s] error reading body %v\n", requestID(r), err)
+			writeError(w, http.StatusBadRequest, ErrorInvalidBody, fmt.Sprintf("error reading body %v", err))
+			return
+		}
+	}
+
+	if queue != nil {
+		queueRequest(w, r)
+		return
+	}
+
+	in := newIngest(r)
+
+	var body io.Reader = r.Body
+	format := inputFormat
+	if fluentdCompat || autoDetectFormat {
+		size := 4096
+		if autoDetectBytes > size {
+			size = autoDetectBytes
+		}
+		br := bufio.NewReaderSize(r.Body, size)
+		if fluentdCompat && isFluentdRequest(r, br) {
+			err := readFluentdEntries(in, requestMediaType(r), br)
+			if err != nil {
+				in.logf("%v\n", err)
+				writeError(w, http.StatusBadRequest, ErrorInvalidBody, err.Error())
+				return
+			}
+			in.finish()
+			writeResponse(w, in.status(), newIngestSummary(in), r)
+			return
+		}
+		if autoDetectFormat {
+			if detected := detectInputFormat(br, autoDetectBytes); detected != "" {
+				format = detected
+			}
+			in.format = format
+		}
+		body = br
+	}
 
-	scanner := bufio.NewScanner(r.Body)
+	readInput(in, body, format)
+
+	in.finish()
+
+	if vectorCompat {
+		writeVectorAck(w, r)
+		return
+	}
+	writeResponse(w, in.status(), newIngestSummary(in), r)
+}
+
+// readJSONLines processes a body of newline delimited JSON events, skipping
+// any lines that fail to parse.
+func readJSONLines(in *ingest, body io.Reader) {
+
+	scanner := bufio.NewScanner(body)
 	buf := make([]byte, MaxLineLength)
 	scanner.Buffer(buf, MaxLineLength)
 
-	total := 0
-	success := 0
 	for scanner.Scan() {
-		total++
+		in.total++
 
 		rawData := scanner.Bytes()
-		var data map[string]interface{}
-		err := json.Unmarshal(rawData, &data)
+		data := getEventMap()
+		var err error
+		if !parseLine(rawData, data) {
+			err = unmarshalEvent(rawData, data)
+		}
 		if err != nil {
-			fmt.Printf("json parsing error %v, raw data: %s\n", err, string(rawData))
+			in.logf("json parsing error %v, raw data: %s\n", err, string(rawData))
+			in.parseErrors++
+			putEventMap(data)
 			continue
 		}
 
-		cleanData(data)
+		err = in.process(data, eventTimestamp(data))
+		if err != nil {
+			in.logf("%v, raw data: %s\n", err, string(rawData))
+		}
+	}
+}
+
+// ingest tracks the events received in a single request as they are cleaned,
+// sampled and sent.
+type ingest struct {
+	id             string
+	start          time.Time
+	headerKeys     []string
+	total          int
+	success        int
+	parseErrors    int
+	sendErrors     int
+	format         string
+	forward        []keptEvent
+	fields         map[string]interface{}
+	builder        *libhoney.Builder
+	batch          []keptEvent
+	coalesceSize   int
+	sends          sync.WaitGroup
+	sendLock       sync.Mutex
+	aggregates     map[string]*aggregate
+	aggregateOrder []string
+	rng            *rand.Rand
+	quotaKey       string
+	presampled     bool
+}
+
+func newIngest(r *http.Request) *ingest {
+	in := newHeaderIngest(r.Header.Values)
+	in.id = requestID(r)
+	in.fields = ipRangeFields(r)
+	in.quotaKey = r.Header.Get(QuotaKeyHeader)
+	in.presampled = r.Header.Get(PresampledHeader) == "true"
+	for k, v := range requestHeaderFields(r.Header) {
+		if in.fields == nil {
+			in.fields = make(map[string]interface{})
+		}
+		in.fields[k] = v
+	}
+	return in
+}
+
+// newHeaderIngest starts an ingest whose sampling header fields are looked up
+// with header, which returns every value a field was sent with. This is for
+// sources that aren't HTTP requests.
+func newHeaderIngest(header func(string) []string) *ingest {
 
-		rate, keep, key := determineSampleRate(data)
+	headerKeys := make([]string, len(samplingHeaderFields))
+	for i, h := range samplingHeaderFields {
+		headerKeys[i] = headerValue(header(h))
+	}
 
-		if keep {
-			ev := libhoney.NewEvent()
-			ev.SampleRate = uint(rate)
-			ev.AddField("event.samplekey", key)
+	in := &ingest{
+		id:         newUUID(),
+		start:      time.Now(),
+		headerKeys: headerKeys,
+		rng:        randPool.Get().(*rand.Rand),
+	}
+	if upstream == nil {
+		// kept events are held and sent together at the end of the request
+		// from a builder carrying the fields they all share
+		if batchByRequest {
+			in.builder = libhoney.NewBuilder()
+		}
+		in.coalesceSize = sendCoalesceSize
+	}
+	return in
+}
 
-			err = ev.Add(data)
-			if err != nil {
-				fmt.Printf("event add error %v, raw data: %s\n", err, string(rawData))
-				continue
+// process runs a single parsed event through cleanup and sampling, sending it
+// on if it is kept. A zero timestamp means the event happened now. The caller
+// is responsible for counting it in total, and hands ownership of data over:
+// it is returned to the event map pool unless it is held for a later send.
+func (in *ingest) process(data map[string]interface{}, timestamp time.Time) error {
+
+	// taken before the field names can be changed by cleaning
+	var edge *edgeDecision
+	if in.presampled {
+		edge = takeEdgeDecision(data)
+	}
+	normalizeInputFields(data)
+	if in.format != "" && in.builder == nil {
+		data["honeylog.input_format"] = in.format
+	}
+	timedOut, err := in.cleanWithTimeout(data)
+	if timedOut {
+		in.logf("dropping event: processing took longer than %v\n", eventProcessingTimeout)
+		return nil
+	}
+	if err != nil {
+		in.logf("dropping event: %v\n", err)
+		putEventMap(data)
+		return nil
+	}
+
+	if dedup != nil && dedup.duplicate(data) {
+		dedupDropped.Inc()
+		putEventMap(data)
+		return nil
+	}
+
+	if counters != nil && counters.add(data, timestamp) {
+		return nil
+	}
+	if len(aggregateFields) > 0 {
+		in.aggregate(data, timestamp)
+		return nil
+	}
+	return in.sample(data, timestamp, edge)
+}
+
+// inject adds the fields shared by every event in the ingest and any
+// enrichment data to an event. When the ingest's events are sent from a
+// builder, the shared fields are left to the builder instead.
+func (in *ingest) inject(data map[string]interface{}) error {
+
+	if in.builder == nil {
+		for k, v := range in.fields {
+			if _, err := injectField(data, k, v); err != nil {
+				return err
 			}
+		}
+	}
+	if enricher != nil {
+		return enricher.enrich(data)
+	}
+	return nil
+}
 
-			err = ev.SendPresampled()
-			if err != nil {
-				fmt.Printf("event send error %v, raw data: %s\n", err, string(rawData))
-				continue
+// sample makes the sampling decision for a cleaned event and sends it on if it
+// is kept, taking ownership of data. An event already sampled by a forwarding
+// honeylog keeps that decision.
+func (in *ingest) sample(data map[string]interface{}, timestamp time.Time, edge *edgeDecision) error {
+
+	var route RuleResult
+	if routingRules != nil {
+		route = routingRules.Evaluate(data)
+		if route.Drop {
+			routingDropped.Inc()
+			putEventMap(data)
+			return nil
+		}
+		for k, v := range route.Tags {
+			data[fieldName(k)] = v
+		}
+	}
+
+	var rate int
+	var keep bool
+	var key string
+	if edge != nil {
+		rate, keep, key = edge.rate, true, edge.key
+	} else {
+		rate, keep, key = determineSampleRate(data, in.headerKeys, route.SampleRate, in.rng)
+	}
+	count := sampler.Count(key)
+	// priority events are always kept, whatever their key's quota
+	if keep && !isPriorityEvent(data) {
+		rate, keep = quotas.apply(in.quotaKey, rate, in.rng)
+	}
+	if !keep || !limitEventSize(data) {
+		putEventMap(data)
+		return nil
+	}
+
+	streams.publish(data, key, rate)
+
+	dataset := route.Dataset
+	if dataset == "" {
+		dataset = eventDataset(data)
+	}
+	event := keptEvent{data: data, rate: rate, key: key, count: count, timestamp: timestamp, dataset: dataset}
+	localOutput.write(event)
+	if upstream != nil {
+		in.forward = append(in.forward, event)
+		return nil
+	}
+	if in.builder != nil || in.coalesceSize > 1 {
+		in.batch = append(in.batch, event)
+		if in.coalesceSize > 1 && len(in.batch) >= in.coalesceSize {
+			in.dispatchBatch()
+		}
+		return nil
+	}
+
+	err := sendEvent(nil, event)
+	putEventMap(data)
+	if err != nil {
+		in.sendErrors++
+		return err
+	}
+	in.success++
+	return nil
+}
+
+// status returns the HTTP status code to respond with once the request has
+// been processed.
+func (in *ingest) status() int {
+	if in.parseErrors > 0 {
+		return partialSuccessStatusCode
+	}
+	return successStatusCode
+}
+
+// finish sends anything that was held back for batching and logs a summary.
+func (in *ingest) finish() {
+
+	if len(in.aggregateOrder) > 0 {
+		in.flushAggregates()
+	}
+
+	if len(in.forward) > 0 {
+		sent := forwardEvents(in.forward)
+		in.success += sent
+		in.sendErrors += len(in.forward) - sent
+		in.forward = nil
+	}
+
+	if len(in.batch) > 0 {
+		in.sendBatch(in.batch)
+		in.batch = nil
+	}
+	in.sends.Wait()
+
+	randPool.Put(in.rng)
+
+	linesReceived.Add(int64(in.total))
+	eventsSent.Add(int64(in.success))
+	parseErrors.Add(int64(in.parseErrors))
+	sendErrors.Add(int64(in.sendErrors))
+
+	in.logf("Sampled %d of %d input lines in %dms.\n", in.success, in.total, time.Now().Sub(in.start).Milliseconds())
+
+	errorRate.record(int64(in.total), int64(in.parseErrors+in.sendErrors))
+}
+
+// dispatchBatch hands the events held so far to a goroutine to send, so the
+// request can carry on parsing while they go to libhoney. finish waits for
+// every dispatched batch.
+func (in *ingest) dispatchBatch() {
+
+	batch := in.batch
+	in.batch = nil
+	in.sends.Add(1)
+	go func() {
+		defer in.sends.Done()
+		in.sendBatch(batch)
+	}()
+}
+
+// sendBatch sends events held for the request, from its builder if it has
+// one. The fields shared by every event in the request are set on the
+// builder, while each event keeps its own sample rate, key and timestamp.
+func (in *ingest) sendBatch(batch []keptEvent) {
+
+	if in.builder != nil {
+		for k, v := range in.fields {
+			in.builder.AddField(k, v)
+		}
+		if in.format != "" {
+			in.builder.AddField(fieldName("honeylog.input_format"), in.format)
+		}
+	}
+	var sent, failed int
+	for _, e := range batch {
+		err := sendEvent(in.builder, e)
+		putEventMap(e.data)
+		if err != nil {
+			failed++
+			in.logf("%v\n", err)
+			continue
+		}
+		sent++
+	}
+
+	in.sendLock.Lock()
+	in.success += sent
+	in.sendErrors += failed
+	in.sendLock.Unlock()
+}
+
+// sendEvent sends a kept event directly to Honeycomb, once to each dataset
+// it fans out to, or if it doesn't, to the dataset a routing rule or the
+// dataset template chose or the default dataset. Events are created from builder if it isn't nil.
+func sendEvent(builder *libhoney.Builder, e keptEvent) error {
+
+	datasets := fanOutDatasets(e.data)
+	if len(datasets) == 0 {
+		if err := sendEventTo(builder, e, e.dataset); err != nil {
+			return err
+		}
+		runPostSendHooks(e)
+		return nil
+	}
+
+	// hooks run once for the event, however many datasets it went to
+	var firstErr error
+	var sentAny bool
+	for _, dataset := range datasets {
+		if err := sendEventTo(builder, e, dataset); err != nil {
+			if firstErr == nil {
+				firstErr = err
 			}
+			continue
+		}
+		sentAny = true
+	}
+	if sentAny {
+		runPostSendHooks(e)
+	}
+	return firstErr
+}
+
+// sendEventTo sends a kept event to a dataset, or the default dataset if it
+// is empty.
+func sendEventTo(builder *libhoney.Builder, e keptEvent, dataset string) error {
+
+	var ev *libhoney.Event
+	if builder != nil {
+		ev = builder.NewEvent()
+	} else {
+		ev = libhoney.NewEvent()
+	}
+	if dataset != "" {
+		ev.Dataset = dataset
+	}
+	ev.SampleRate = uint(e.rate)
+	if !e.timestamp.IsZero() {
+		ev.Timestamp = e.timestamp
+	}
+	ev.AddField(metaField("samplekey"), e.key)
+	ev.AddField(fieldName("honeylog.sample_rate"), e.rate)
+	ev.AddField(fieldName("honeylog.sample_key"), e.key)
+	ev.AddField(fieldName("honeylog.sampled_count"), e.count)
 
-			success++
+	// add fields one at a time in a fixed order so output is reproducible
+	if sortFields {
+		for _, k := range fieldsByPriority(e.data) {
+			ev.AddField(k, e.data[k])
 		}
+	} else if err := ev.Add(e.data); err != nil {
+		return fmt.Errorf("event add error %v", err)
+	}
+	if err := ev.SendPresampled(); err != nil {
+		return fmt.Errorf("event send error %v", err)
 	}
+	return nil
+}
 
-	fmt.Printf("Sampled %d of %d input lines in %dms.\n", success, total, time.Now().Sub(startTime).Milliseconds())
+// forwardEvents sends kept events to the upstream honeylog instance, falling
+// back to sending directly to Honeycomb if configured to. It returns the number
+// of events successfully handed off.
+func forwardEvents(events []keptEvent) int {
 
-	w.WriteHeader(200)
+	err := upstream.forward(events)
+	if err == nil {
+		return len(events)
+	}
+	fmt.Printf("upstream forward error %v, %d events\n", err, len(events))
+	if !upstream.fallback {
+		return 0
+	}
+	return sendFallback(events)
+}
+
+// sendFallback sends events that couldn't be forwarded directly to Honeycomb
+// and returns how many were sent.
+func sendFallback(events []keptEvent) int {
+
+	sent := 0
+	for _, e := range events {
+		if err := sendEvent(nil, e); err != nil {
+			fmt.Printf("fallback %v\n", err)
+			continue
+		}
+		sent++
+	}
+	return sent
 }
 
-func cleanData(data map[string]interface{}) {
+// cleanData tidies up an event before sampling, breaking out URL fields with
+// the parsers in shapers. An error is returned if the event should be dropped:
+// a field it adds collides with an existing one under the error collision
+// policy, or a boolean field can't be read as one under the drop_event policy.
+func cleanData(data map[string]interface{}, shapers *urlShaperSet) error {
 
 	// Use this to perform any general data cleanup
 
+	applyFieldOverrides(data)
+	if err := migrateFields(data); err != nil {
+		return err
+	}
+	expandEnvFields(data)
+	maskFields(data)
+	extractMessageTags(data)
+	if beelineCompat {
+		translateBeeline(data)
+	}
+	// decode first so the fields it produces get the same treatment
+	if err := decodeBase64Fields(data); err != nil {
+		return err
+	}
+	if err := coerceBoolFields(data); err != nil {
+		return err
+	}
+	// note types before slices are flattened into strings below
+	if err := annotateTypes(data); err != nil {
+		return err
+	}
+
+	var shapeFields []string
 	for k, v := range data {
 		// if value is a slice, convert to a string slice, and use a string representation of it
 		// if the slice is a slice of objects this will not produce desired results
-		if reflect.TypeOf(v).Kind() == reflect.Slice {
+		if v != nil && reflect.TypeOf(v).Kind() == reflect.Slice {
 			sval := reflect.ValueOf(v)
 			newVal := make([]string, sval.Len())
 			for i := 0; i < sval.Len(); i++ {
@@ -165,47 +1430,85 @@ func cleanData(data map[string]interface{}) {
 			data[k] = strings.Join(newVal, ",")
 		}
 
-		// if the field is a URL field, use urlshaper to break it out into its components
-		shaper := &urlshaper.Parser{}
-		for _, f := range urlFields {
-			if k == f {
-				res, err := shaper.Parse(fmt.Sprintf("%v", v))
-				if err == nil {
-					data[k+".path"] = res.Path
-					for pk, pv := range res.PathFields {
-						data[k+".pathFields."+pk] = strings.Join(pv, ",")
-					}
-					data[k+".pathShape"] = res.PathShape
-					data[k+".query"] = res.Query
-					for qk, qv := range res.QueryFields {
-						data[k+".queryFields."+qk] = strings.Join(qv, ",")
-					}
-					data[k+".queryShape"] = res.QueryShape
-					data[k+".uri"] = res.URI
-				}
-			}
-			break
+		// note URL fields to be broken out once we're done iterating, so the
+		// fields they produce aren't themselves mistaken for URL fields
+		if shapers.forField(k) != nil {
+			shapeFields = append(shapeFields, k)
 		}
 	}
+
+	// use urlshaper to break URL fields out into their components
+	for _, k := range shapeFields {
+		if err := shapeURLField(data, k, shapers.forField(k)); err != nil {
+			return err
+		}
+	}
+
+	normalizeFloats(data)
+
+	if err := applyFieldTemplates(data); err != nil {
+		return err
+	}
+
+	limitFieldLengths(data)
+	limitFields(data)
+
+	convertFieldNames(data)
+	return nil
 }
 
-func determineSampleRate(data map[string]interface{}) (rate int, keep bool, key string) {
+// samplingKey builds the sampling key of an event from its sampling fields,
+// with any values taken from request headers leading the key.
+func samplingKey(data map[string]interface{}, headerKeys []string) string {
 
-	// will determine the sample rate of an event based on sampling fields
+	if structuralSampling {
+		keys := append(append(make([]string, 0, len(headerKeys)+1), headerKeys...), schemaFingerprint(data))
+		return strings.Join(keys, KeySeperatorChar)
+	}
 
-	keys := make([]string, len(samplingFields))
-	for i, field := range samplingFields {
+	fields := currentSamplingFields()
+	keys := make([]string, len(headerKeys)+len(fields))
+	copy(keys, headerKeys)
+	for i, field := range fields {
 		if val, ok := data[field]; ok {
-			keys[i] = fmt.Sprintf("%v", val)
+			keys[len(headerKeys)+i] = samplingKeyValue(val)
 		}
 	}
-	key = strings.Join(keys, KeySeperatorChar)
+	return strings.Join(keys, KeySeperatorChar)
+}
+
+func determineSampleRate(data map[string]interface{}, headerKeys []string, ruleRate int, rng *rand.Rand) (rate int, keep bool, key string) {
 
-	rate = sampler.GetSampleRate(key)
+	// will determine the sample rate of an event based on sampling fields
+	key = samplingKey(data, headerKeys)
+
+	// an override set by an operator takes precedence over the sampler
+	if overrideRate, ok := samplingOverrideRate(data, key); ok {
+		rate = overrideRate
+	} else if ruleRate > 0 {
+		// followed by a routing rule's fixed rate
+		rate = ruleRate
+	} else {
+		// then a sampler of its own if the key has a goal rate of its own
+		if s := keyGoalRates.samplerFor(data, key); s != nil {
+			rate = s.GetSampleRate(key)
+		} else {
+			rate, key = sampler.GetSampleRate(key)
+		}
+		// priority events are always kept, the rest adjusted and bounded
+		var boosted bool
+		if rate, boosted = applyPriorityBoost(data, applyMethodRate(data, rate)); !boosted {
+			rate = clampSampleRate(rate)
+		}
+	}
 	// protect against something going weird in the sampler
 	if rate < 1 {
 		rate = 1
 	}
-	keep = rand.Intn(int(rate)) == 0
+	// the sampler still sees every key during warm up, but doesn't get a say yet
+	if time.Now().Before(samplerWarmupUntil) {
+		rate = 1
+	}
+	keep = rng.Intn(rate) == 0
 	return rate, keep, key
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+var maskRules []maskRule
+
+// maskRule replaces the parts of a string field matching a pattern, leaving
+// the rest of the value as it was. The replacement may refer to submatches
+// as regexp.ReplaceAllString does.
+type maskRule struct {
+	Field       string `yaml:"field"`
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+
+	re            *regexp.Regexp
+	substitutions *counter
+}
+
+// loadMaskRules reads a JSON or YAML list of mask rules and compiles their
+// patterns.
+func loadMaskRules(path string) ([]maskRule, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []maskRule
+	if err := yaml.Unmarshal(raw, &rules); err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string]*counter)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Field == "" || rule.Pattern == "" {
+			return nil, fmt.Errorf("mask rule %d needs a field and a pattern", i+1)
+		}
+		if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("mask rule %d: %v", i+1, err)
+		}
+		// one series per field, however many rules mask it
+		c, ok := counters[rule.Field]
+		if !ok {
+			c = metrics.LabeledCounter("honeylog_masking_substitutions_total", fmt.Sprintf("field=%q", rule.Field), "Substrings of field values replaced by MASK_PATTERNS rules.")
+			counters[rule.Field] = c
+		}
+		rule.substitutions = c
+	}
+	return rules, nil
+}
+
+// maskFields applies the mask rules to each event, in the order they were
+// configured.
+func maskFields(data map[string]interface{}) {
+
+	for i := range maskRules {
+		rule := &maskRules[i]
+		s, ok := data[rule.Field].(string)
+		if !ok {
+			continue
+		}
+		n := len(rule.re.FindAllStringIndex(s, -1))
+		if n == 0 {
+			continue
+		}
+		data[rule.Field] = rule.re.ReplaceAllString(s, rule.Replacement)
+		rule.substitutions.Add(int64(n))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultMessageTagPattern matches tags written like [key=value].
+const DefaultMessageTagPattern = `\[(?P<key>[a-z_]+)=(?P<value>[^\]]+)\]`
+
+var messageTagField string
+var messageTagPattern *regexp.Regexp
+var stripExtractedTags bool
+
+// compileMessageTagPattern compiles a MESSAGE_TAG_PATTERN, which must have
+// named key and value groups.
+func compileMessageTagPattern(pattern string) (*regexp.Regexp, error) {
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message tag pattern: %v", err)
+	}
+	if re.SubexpIndex("key") < 0 || re.SubexpIndex("value") < 0 {
+		return nil, fmt.Errorf("message tag pattern %q must have named key and value groups", pattern)
+	}
+	return re, nil
+}
+
+// extractMessageTags adds every tag found in the message field as a top-level
+// field, optionally removing the tags from the message. Fields the event
+// already has are left alone.
+func extractMessageTags(data map[string]interface{}) {
+
+	if messageTagField == "" {
+		return
+	}
+	message, ok := data[messageTagField].(string)
+	if !ok {
+		return
+	}
+
+	keyIndex := messageTagPattern.SubexpIndex("key")
+	valueIndex := messageTagPattern.SubexpIndex("value")
+	matches := messageTagPattern.FindAllStringSubmatch(message, -1)
+	if len(matches) == 0 {
+		return
+	}
+	for _, match := range matches {
+		key := match[keyIndex]
+		if key == "" || key == messageTagField {
+			continue
+		}
+		if _, exists := data[key]; !exists {
+			data[key] = match[valueIndex]
+		}
+	}
+
+	if stripExtractedTags {
+		stripped := messageTagPattern.ReplaceAllString(message, "")
+		data[messageTagField] = strings.Join(strings.Fields(stripped), " ")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const DefaultSamplingMethodField = "method"
+
+var samplingMethodField string
+var samplingMethodRates map[string]float64
+
+// parseSamplingMethodRates reads SAMPLING_METHOD_RATES style value:multiplier
+// pairs, such as GET:100. Values are matched case-insensitively.
+func parseSamplingMethodRates(pairs []string) (map[string]float64, error) {
+
+	rates := make(map[string]float64, len(pairs))
+	for _, pair := range pairs {
+		value, raw, ok := strings.Cut(pair, ":")
+		value = strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid sampling method rate %q, expected value:multiplier", pair)
+		}
+		multiplier, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil || multiplier <= 0 {
+			return nil, fmt.Errorf("invalid sampling method rate %q, multiplier must be a positive number", pair)
+		}
+		rates[strings.ToUpper(value)] = multiplier
+	}
+	return rates, nil
+}
+
+// applyMethodRate multiplies a sampler rate by the multiplier configured for
+// the event's method field, if any.
+func applyMethodRate(data map[string]interface{}, rate int) int {
+
+	if len(samplingMethodRates) == 0 {
+		return rate
+	}
+	v, ok := data[samplingMethodField]
+	if !ok || v == nil {
+		return rate
+	}
+	multiplier, ok := samplingMethodRates[strings.ToUpper(fmt.Sprintf("%v", v))]
+	if !ok {
+		return rate
+	}
+	scaled := math.Round(float64(rate) * multiplier)
+	if scaled > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(scaled)
+}
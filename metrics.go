@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var metrics = &metricRegistry{}
+
+// metricRegistry holds the metrics exposed on /metrics in the Prometheus text
+// exposition format. Metrics are registered once at startup.
+type metricRegistry struct {
+	lock    sync.Mutex
+	metrics []*metric
+}
+
+type metric struct {
+	name   string
+	labels string
+	help   string
+	kind   string
+	value  func() float64
+}
+
+// counter is a monotonically increasing metric that is safe for concurrent use.
+type counter struct {
+	value int64
+}
+
+func (c *counter) Inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+func (c *counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// Counter registers and returns a new counter.
+func (m *metricRegistry) Counter(name, help string) *counter {
+	c := &counter{}
+	m.register(&metric{name: name, help: help, kind: "counter", value: func() float64 {
+		return float64(c.Value())
+	}})
+	return c
+}
+
+// LabeledCounter registers and returns a new counter reported with labels,
+// such as action="drop". Counters sharing a name are reported together.
+func (m *metricRegistry) LabeledCounter(name, labels, help string) *counter {
+	c := &counter{}
+	m.register(&metric{name: name, labels: labels, help: help, kind: "counter", value: func() float64 {
+		return float64(c.Value())
+	}})
+	return c
+}
+
+// Gauge registers a gauge whose value is read from fn at scrape time.
+func (m *metricRegistry) Gauge(name, help string, fn func() float64) {
+	m.register(&metric{name: name, help: help, kind: "gauge", value: fn})
+}
+
+func (m *metricRegistry) register(mt *metric) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.metrics = append(m.metrics, mt)
+}
+
+// serveMetrics writes all registered metrics in name order, labeled ones in
+// the order they were registered.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+
+	metrics.lock.Lock()
+	list := make([]*metric, len(metrics.metrics))
+	copy(list, metrics.metrics)
+	metrics.lock.Unlock()
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for i, mt := range list {
+		if i == 0 || list[i-1].name != mt.name {
+			fmt.Fprintf(w, "# HELP %s %s\n", mt.name, mt.help)
+			fmt.Fprintf(w, "# TYPE %s %s\n", mt.name, mt.kind)
+		}
+		if mt.labels != "" {
+			fmt.Fprintf(w, "%s{%s} %v\n", mt.name, mt.labels, mt.value())
+			continue
+		}
+		fmt.Fprintf(w, "%s %v\n", mt.name, mt.value())
+	}
+}
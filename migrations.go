@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var fieldMigrations []fieldMigration
+
+// fieldMigration renames fields of events that happened before a cutoff, so
+// events from before a service renamed a field line up with those after.
+type fieldMigration struct {
+	Before  time.Time         `yaml:"before"`
+	Renames map[string]string `yaml:"renames"`
+}
+
+// loadFieldMigrations reads a YAML list of field migrations, ordered by
+// cutoff so that a field renamed more than once ends up with its latest name.
+func loadFieldMigrations(path string) ([]fieldMigration, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []fieldMigration
+	if err := yaml.Unmarshal(raw, &migrations); err != nil {
+		return nil, err
+	}
+	for i, m := range migrations {
+		if m.Before.IsZero() {
+			return nil, fmt.Errorf("field migration %d has no before time", i+1)
+		}
+		if len(m.Renames) == 0 {
+			return nil, fmt.Errorf("field migration %d has no renames", i+1)
+		}
+	}
+	sort.SliceStable(migrations, func(i, j int) bool { return migrations[i].Before.Before(migrations[j].Before) })
+	return migrations, nil
+}
+
+// migrateFields applies the renames of every migration whose cutoff is after
+// the event's timestamp. Events without a timestamp are taken to be current
+// and are left alone.
+func migrateFields(data map[string]interface{}) error {
+
+	if len(fieldMigrations) == 0 {
+		return nil
+	}
+	ts := eventTimestamp(data)
+	if ts.IsZero() {
+		return nil
+	}
+	for _, m := range fieldMigrations {
+		if !ts.Before(m.Before) {
+			continue
+		}
+		for from, to := range m.Renames {
+			v, ok := data[from]
+			if !ok {
+				continue
+			}
+			delete(data, from)
+			if _, err := injectField(data, to, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
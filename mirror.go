@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const DefaultMirrorTimeoutMS = 2000
+
+var mirror *mirrorSender
+
+var mirrorErrors = metrics.Counter("honeylog_mirror_errors_total", "Request bodies that could not be mirrored.")
+
+// mirrorSender copies request bodies to another endpoint, usually another
+// honeylog instance with its own sampling configuration. Mirroring is fire and
+// forget: it never holds up or changes the response to the original request,
+// though a body that can't be read fails the request as it would unmirrored.
+type mirrorSender struct {
+	url    string
+	client *http.Client
+}
+
+// newMirrorSender configures mirroring from the environment. It returns nil
+// when MIRROR_URL is not set.
+func newMirrorSender() (*mirrorSender, error) {
+
+	rawURL := os.Getenv("MIRROR_URL")
+	if rawURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported mirror scheme %q", u.Scheme)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if envBool("MIRROR_SKIP_TLS_VERIFY") {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	timeout := envInt("MIRROR_TIMEOUT_MS", DefaultMirrorTimeoutMS)
+	if timeout <= 0 {
+		timeout = DefaultMirrorTimeoutMS
+	}
+
+	return &mirrorSender{
+		url:    rawURL,
+		client: &http.Client{Timeout: time.Duration(timeout) * time.Millisecond, Transport: transport},
+	}, nil
+}
+
+// tee reads the whole request body so a copy can be sent to the mirror in the
+// background, and replaces it with one that replays what was read. If the
+// body can't be read, nothing is mirrored and the error is returned, since
+// processing what was read would drop the rest of the body unnoticed.
+func (m *mirrorSender) tee(r *http.Request) error {
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	header := r.Header.Clone()
+	go m.send(body, header)
+	return nil
+}
+
+func (m *mirrorSender) send(body []byte, header http.Header) {
+
+	req, err := http.NewRequest(http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		mirrorErrors.Inc()
+		fmt.Printf("mirror error %v\n", err)
+		return
+	}
+	req.Header = header
+	req.Header.Del("Content-Length")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		mirrorErrors.Inc()
+		fmt.Printf("mirror error %v\n", err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		mirrorErrors.Inc()
+		fmt.Printf("mirror error %s responded %s\n", m.url, resp.Status)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// failingReader returns some of a body, then an error.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestMirroredBodyReadError(t *testing.T) {
+
+	defer func(m *mirrorSender) { mirror = m }(mirror)
+	mirror = &mirrorSender{url: "http://127.0.0.1:1", client: &http.Client{}}
+
+	body := &failingReader{r: strings.NewReader(`{"service":"a"}` + "\n")}
+	r := httptest.NewRequest(http.MethodPost, "/", body)
+	w := httptest.NewRecorder()
+	readNewData(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
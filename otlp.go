@@ -0,0 +1,202 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultOTLPMaxBodyBytes is the largest OTLP export accepted, measured after
+// decompression.
+const DefaultOTLPMaxBodyBytes = 16 << 20
+
+var otlpMaxBodyBytes int64 = DefaultOTLPMaxBodyBytes
+
+// readOTLPLogs accepts OTLP/HTTP log exports, flattening each log record into
+// an event with the attributes of its resource and scope.
+func readOTLPLogs(w http.ResponseWriter, r *http.Request) {
+
+	defer trackInFlight()()
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, "use POST")
+		return
+	}
+	w.Header().Set("X-Request-ID", requestID(r))
+	in := newIngest(r)
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			in.logf("otlp gzip error %v\n", err)
+			writeError(w, http.StatusBadRequest, ErrorBadContentEncoding, fmt.Sprintf("otlp gzip error %v", err))
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	raw, err := io.ReadAll(io.LimitReader(body, otlpMaxBodyBytes+1))
+	if err != nil {
+		in.logf("otlp read error %v\n", err)
+		writeError(w, http.StatusBadRequest, ErrorInvalidBody, fmt.Sprintf("otlp read error %v", err))
+		return
+	}
+	if int64(len(raw)) > otlpMaxBodyBytes {
+		in.logf("otlp body exceeds %d bytes\n", otlpMaxBodyBytes)
+		writeError(w, http.StatusRequestEntityTooLarge, ErrorBodyTooLarge, fmt.Sprintf("otlp body exceeds %d bytes", otlpMaxBodyBytes))
+		return
+	}
+
+	var req collogspb.ExportLogsServiceRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJSON := mediaType == "application/json"
+	if isJSON {
+		err = protojson.Unmarshal(raw, &req)
+	} else {
+		err = proto.Unmarshal(raw, &req)
+	}
+	if err != nil {
+		in.logf("otlp parsing error %v\n", err)
+		writeError(w, http.StatusBadRequest, ErrorInvalidBody, fmt.Sprintf("otlp parsing error %v", err))
+		return
+	}
+
+	for _, rl := range req.GetResourceLogs() {
+		for _, sl := range rl.GetScopeLogs() {
+			for _, record := range sl.GetLogRecords() {
+				in.total++
+
+				data := getEventMap()
+				addOTLPAttributes(data, "", rl.GetResource().GetAttributes())
+				if name := sl.GetScope().GetName(); name != "" {
+					data["library.name"] = name
+				}
+				if version := sl.GetScope().GetVersion(); version != "" {
+					data["library.version"] = version
+				}
+				addOTLPAttributes(data, "", record.GetAttributes())
+				translateOTLPLogRecord(data, record)
+
+				err := in.process(data, otlpTimestamp(record))
+				if err != nil {
+					in.logf("%v\n", err)
+				}
+			}
+		}
+	}
+	in.finish()
+
+	// OTLP exporters expect an export response, so the summary is only sent
+	// to clients that ask for it as text
+	if prefersText(r.Header.Get("Accept")) {
+		writeResponse(w, in.status(), newIngestSummary(in), r)
+		return
+	}
+	resp := &collogspb.ExportLogsServiceResponse{}
+	var out []byte
+	if isJSON {
+		out, err = protojson.Marshal(resp)
+	} else {
+		out, err = proto.Marshal(resp)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(in.status())
+	w.Write(out)
+}
+
+// translateOTLPLogRecord adds the fields describing a log record itself.
+func translateOTLPLogRecord(data map[string]interface{}, record *logspb.LogRecord) {
+
+	if body := otlpValue(record.GetBody()); body != nil {
+		data["body"] = body
+	}
+	if id := record.GetTraceId(); len(id) > 0 {
+		data["trace.trace_id"] = hex.EncodeToString(id)
+	}
+	if id := record.GetSpanId(); len(id) > 0 {
+		data["trace.span_id"] = hex.EncodeToString(id)
+	}
+
+	severity := record.GetSeverityText()
+	if severity == "" && record.GetSeverityNumber() != logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED {
+		severity = strings.ToLower(strings.TrimPrefix(record.GetSeverityNumber().String(), "SEVERITY_NUMBER_"))
+	}
+	if severity != "" {
+		data["severity"] = severity
+	}
+}
+
+// otlpTimestamp returns when a log record happened, falling back to when it
+// was observed.
+func otlpTimestamp(record *logspb.LogRecord) time.Time {
+
+	ns := record.GetTimeUnixNano()
+	if ns == 0 {
+		ns = record.GetObservedTimeUnixNano()
+	}
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ns))
+}
+
+// addOTLPAttributes copies attributes into data, flattening nested key value
+// lists into dotted field names.
+func addOTLPAttributes(data map[string]interface{}, prefix string, attrs []*commonpb.KeyValue) {
+
+	for _, kv := range attrs {
+		name := prefix + kv.GetKey()
+		if kvlist := kv.GetValue().GetKvlistValue(); kvlist != nil {
+			addOTLPAttributes(data, name+".", kvlist.GetValues())
+			continue
+		}
+		if value := otlpValue(kv.GetValue()); value != nil {
+			data[name] = value
+		}
+	}
+}
+
+// otlpValue converts an OTLP AnyValue to a plain Go value.
+func otlpValue(v *commonpb.AnyValue) interface{} {
+
+	switch value := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return value.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return value.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return value.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return value.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(value.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		values := value.ArrayValue.GetValues()
+		out := make([]interface{}, len(values))
+		for i, item := range values {
+			out[i] = otlpValue(item)
+		}
+		return out
+	case *commonpb.AnyValue_KvlistValue:
+		out := make(map[string]interface{})
+		addOTLPAttributes(out, "", value.KvlistValue.GetValues())
+		return out
+	}
+	return nil
+}
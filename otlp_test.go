@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadOTLPLogsDecompressedLimit(t *testing.T) {
+
+	defer func(n int64) { otlpMaxBodyBytes = n }(otlpMaxBodyBytes)
+	otlpMaxBodyBytes = 1024
+
+	// a few hundred compressed bytes that inflate well past the limit
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(make([]byte, 1<<20))
+	gz.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/logs", &buf)
+	r.Header.Set("Content-Encoding", "gzip")
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	readOTLPLogs(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
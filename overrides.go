@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// samplingOverrides holds the current []samplingOverride.
+var samplingOverrides atomic.Value
+
+// samplingOverride pins the sample rate for matching events until it expires.
+// Key is either a comma-separated list of field=value conditions that must
+// all match the event, or a literal sampling key.
+type samplingOverride struct {
+	Key     string     `json:"key"`
+	Rate    int        `json:"rate"`
+	Expires *time.Time `json:"expires,omitempty"`
+
+	conditions map[string]string
+}
+
+func (o *samplingOverride) matches(data map[string]interface{}, key string) bool {
+	if o.conditions == nil {
+		return o.Key == key
+	}
+	for field, value := range o.conditions {
+		v, ok := data[field]
+		if !ok || fmt.Sprintf("%v", v) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (o *samplingOverride) expired(now time.Time) bool {
+	return o.Expires != nil && now.After(*o.Expires)
+}
+
+// loadSamplingOverrides reads a JSON list of overrides.
+func loadSamplingOverrides(path string) ([]samplingOverride, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overrides []samplingOverride
+	if err := json.Unmarshal(raw, &overrides); err != nil {
+		return nil, err
+	}
+	if err := prepareSamplingOverrides(overrides); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// prepareSamplingOverrides clamps override rates and parses their conditions.
+func prepareSamplingOverrides(overrides []samplingOverride) error {
+
+	for i := range overrides {
+		o := &overrides[i]
+		if o.Rate < 1 {
+			o.Rate = 1
+		}
+		if !strings.Contains(o.Key, "=") {
+			continue
+		}
+		o.conditions = make(map[string]string)
+		for _, cond := range strings.Split(o.Key, ",") {
+			field, value, ok := strings.Cut(cond, "=")
+			if !ok {
+				return fmt.Errorf("invalid override condition %q", cond)
+			}
+			o.conditions[strings.TrimSpace(field)] = strings.TrimSpace(value)
+		}
+	}
+	return nil
+}
+
+// watchSamplingOverrides loads the override file and reloads it whenever it
+// changes. The directory is watched rather than the file, so that editors and
+// config management tools that replace the file are picked up too. A file
+// that fails to load leaves the previous overrides in place.
+func watchSamplingOverrides(path string) error {
+
+	overrides, err := loadSamplingOverrides(path)
+	if err != nil {
+		return err
+	}
+	samplingOverrides.Store(overrides)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != filepath.Clean(path) || ev.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				overrides, err := loadSamplingOverrides(path)
+				if err != nil {
+					fmt.Printf("error reloading sampling overrides: %v\n", err)
+					continue
+				}
+				previous, _ := samplingOverrides.Load().([]samplingOverride)
+				samplingOverrides.Store(overrides)
+				configAudit.record("watcher", overrideAuditValues("file.override.", previous), overrideAuditValues("file.override.", overrides))
+				fmt.Printf("Loaded %d sampling overrides from %s\n", len(overrides), path)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Printf("error watching sampling overrides: %v\n", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// samplingOverrideRate returns the rate from the first unexpired override
+// matching the event, if any.
+func samplingOverrideRate(data map[string]interface{}, key string) (int, bool) {
+
+	now := time.Now()
+	for _, source := range []*atomic.Value{&samplingOverrides, &dbSamplingOverrides} {
+		overrides, _ := source.Load().([]samplingOverride)
+		for i := range overrides {
+			o := &overrides[i]
+			if !o.expired(now) && o.matches(data, key) {
+				return o.Rate, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// activeSamplingOverrides returns the overrides that have not expired.
+func activeSamplingOverrides() []samplingOverride {
+
+	now := time.Now()
+	active := []samplingOverride{}
+	for _, source := range []*atomic.Value{&samplingOverrides, &dbSamplingOverrides} {
+		overrides, _ := source.Load().([]samplingOverride)
+		for _, o := range overrides {
+			if !o.expired(now) {
+				active = append(active, o)
+			}
+		}
+	}
+	return active
+}
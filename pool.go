@@ -0,0 +1,30 @@
+package main
+
+import "sync"
+
+// MaxPooledEventFields keeps unusually wide events from pinning large maps in
+// the pool.
+const MaxPooledEventFields = 256
+
+var eventMapPool = sync.Pool{
+	New: func() interface{} {
+		return make(map[string]interface{})
+	},
+}
+
+// getEventMap returns an empty event map, reusing one from the pool if possible.
+func getEventMap() map[string]interface{} {
+	return eventMapPool.Get().(map[string]interface{})
+}
+
+// putEventMap clears an event map and returns it to the pool. Nothing may hold
+// a reference to the map once it has been put back.
+func putEventMap(data map[string]interface{}) {
+	if len(data) > MaxPooledEventFields {
+		return
+	}
+	for k := range data {
+		delete(data, k)
+	}
+	eventMapPool.Put(data)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var benchmarkLine = []byte(`{"service":"api","status":200,"duration_ms":12.5,"method":"GET","path":"/users/42","user_agent":"curl/8.0","trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"}`)
+
+// BenchmarkEventMapPooled decodes each event into a map from the pool and
+// returns it once the event is done with.
+func BenchmarkEventMapPooled(b *testing.B) {
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data := getEventMap()
+		if err := json.Unmarshal(benchmarkLine, &data); err != nil {
+			b.Fatal(err)
+		}
+		putEventMap(data)
+	}
+}
+
+// BenchmarkEventMapUnpooled decodes each event into a fresh map.
+func BenchmarkEventMapUnpooled(b *testing.B) {
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var data map[string]interface{}
+		if err := json.Unmarshal(benchmarkLine, &data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPutEventMapClears(t *testing.T) {
+
+	data := getEventMap()
+	data["service"] = "api"
+	putEventMap(data)
+	if len(data) != 0 {
+		t.Errorf("map still has %d fields after being returned to the pool", len(data))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"http-honeylog/hooks"
+)
+
+const DefaultPostSendHookTimeoutMS = 100
+
+var postSendHookTimeout = DefaultPostSendHookTimeoutMS * time.Millisecond
+
+var postSendHookTimeouts = metrics.Counter("honeylog_post_send_hook_timeout_total", "Post-send hook calls that were given up on after POST_SEND_HOOK_TIMEOUT_MS.")
+
+// runPostSendHooks calls the hooks registered with hooks.RegisterPostSendHook
+// for a sent event. A timeout of zero or less waits for each hook however
+// long it takes.
+func runPostSendHooks(e keptEvent) {
+
+	registered := hooks.PostSendHooks()
+	if len(registered) == 0 {
+		return
+	}
+
+	// a hook that times out keeps running after e.data has gone back to the
+	// event map pool, so hooks are given a copy of their own
+	data := make(map[string]interface{}, len(e.data))
+	for k, v := range e.data {
+		data[k] = v
+	}
+	for _, hook := range registered {
+		hook := hook
+		call := func() { hook(data, e.rate, e.key) }
+		if postSendHookTimeout <= 0 {
+			call()
+			continue
+		}
+		if !runWithTimeout(postSendHookTimeout, call) {
+			postSendHookTimeouts.Inc()
+			fmt.Printf("post-send hook timed out after %v\n", postSendHookTimeout)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"http-honeylog/hooks"
+)
+
+func TestPostSendHooksRunOncePerFannedOutEvent(t *testing.T) {
+
+	defer func(rules []fanOutRule) { fanOutRules = rules }(fanOutRules)
+	fanOutRules = []fanOutRule{{Match: map[string]string{"service": "api"}, Datasets: []string{"one", "two"}}}
+	sender := mockLibhoney(t)
+
+	// hooks can't be unregistered, so this one only counts events it's
+	// meant to see
+	var calls int32
+	hooks.RegisterPostSendHook(func(data map[string]interface{}, sampleRate int, key string) {
+		if data["posthook_test"] == true {
+			atomic.AddInt32(&calls, 1)
+		}
+	})
+
+	e := keptEvent{data: map[string]interface{}{"service": "api", "posthook_test": true}, rate: 1, key: "api"}
+	if err := sendEvent(nil, e); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sender.Events()); n != 2 {
+		t.Fatalf("sent %d events, want 2", n)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("hooks ran %d times, want 1", n)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/honeycombio/libhoney-go"
+)
+
+// PreflightSampleRate keeps the preflight event out of the way of anything
+// counting events in the dataset.
+const PreflightSampleRate = 1000000
+
+const preflightMetadata = "honeylog.preflight"
+
+// preflightCheck sends a single test event to Honeycomb and waits for its
+// response, so a bad API key or team is caught before the server starts
+// accepting events that would otherwise be silently dropped.
+func preflightCheck(timeout time.Duration) error {
+
+	ev := libhoney.NewEvent()
+	ev.SampleRate = PreflightSampleRate
+	ev.Metadata = preflightMetadata
+	ev.AddField("test.preflight", true)
+	if err := ev.SendPresampled(); err != nil {
+		return fmt.Errorf("preflight send error %v", err)
+	}
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case resp := <-libhoney.TxResponses():
+			if resp.Metadata != preflightMetadata {
+				continue
+			}
+			switch {
+			case resp.Err != nil:
+				return fmt.Errorf("preflight error %v", resp.Err)
+			case resp.StatusCode == 401:
+				return fmt.Errorf("preflight rejected with status 401, check HONEYCOMB_API_KEY")
+			case resp.StatusCode == 403:
+				return fmt.Errorf("preflight rejected with status 403, check the team and dataset permissions of HONEYCOMB_API_KEY")
+			case resp.StatusCode < 200 || resp.StatusCode > 299:
+				return fmt.Errorf("preflight failed with status %d: %s", resp.StatusCode, resp.Body)
+			}
+			return nil
+		case <-deadline:
+			return fmt.Errorf("preflight timed out after %v", timeout)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const DefaultPriorityBoostFactor = 2
+
+var priorityBoostField string
+var priorityBoostValues map[string]bool
+var priorityBoostFactor float64 = DefaultPriorityBoostFactor
+
+// applyPriorityBoost keeps every event whose priority field holds a boost
+// value, such as level=error, by giving it a rate of 1. Other events have
+// their sampler rate multiplied by priorityBoostFactor to make up for it. It
+// reports whether the event was boosted.
+func applyPriorityBoost(data map[string]interface{}, rate int) (int, bool) {
+
+	if priorityBoostField == "" {
+		return rate, false
+	}
+	if isPriorityEvent(data) {
+		return 1, true
+	}
+	scaled := math.Round(float64(rate) * priorityBoostFactor)
+	if scaled > math.MaxInt32 {
+		return math.MaxInt32, false
+	}
+	return int(scaled), false
+}
+
+// isPriorityEvent reports whether an event's priority field holds one of the
+// boost values.
+func isPriorityEvent(data map[string]interface{}) bool {
+
+	if priorityBoostField == "" {
+		return false
+	}
+	v, ok := data[priorityBoostField]
+	return ok && v != nil && priorityBoostValues[fmt.Sprintf("%v", v)]
+}
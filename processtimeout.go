@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+var eventProcessingTimeout time.Duration
+
+var processingTimeouts = metrics.Counter("honeylog_processing_timeout_total", "Events dropped because cleaning them took longer than EVENT_PROCESSING_TIMEOUT_MS.")
+
+// cleanWithTimeout injects fields into an event and cleans it, giving up
+// after eventProcessingTimeout if that is set. The work can't be interrupted,
+// so on a timeout it carries on in the background and exits when it is done;
+// the event belongs to it from then on and must not be touched again.
+func (in *ingest) cleanWithTimeout(data map[string]interface{}) (timedOut bool, err error) {
+
+	if eventProcessingTimeout <= 0 {
+		return false, in.clean(data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventProcessingTimeout)
+	defer cancel()
+
+	// buffered so the goroutine can always finish, even after we stop waiting
+	done := make(chan error, 1)
+	go func() {
+		done <- in.clean(data)
+	}()
+
+	select {
+	case err := <-done:
+		return false, err
+	case <-ctx.Done():
+		processingTimeouts.Inc()
+		return true, nil
+	}
+}
+
+// clean adds injected fields to an event and cleans it.
+func (in *ingest) clean(data map[string]interface{}) error {
+
+	if err := in.inject(data); err != nil {
+		return err
+	}
+	return cleanData(data, urlShapers)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const DefaultQueueSize = 1000
+const queueCursorFile = "cursor"
+const queueFileSuffix = ".queue"
+
+var errQueueFull = errors.New("queue is full")
+var errQueueStopped = errors.New("queue is stopped")
+
+// queue, when set, decouples reading request bodies from processing them.
+var queue requestQueue
+
+var queueDropped = metrics.Counter("honeylog_queue_dropped_total", "Queued request bodies dropped to stay within MAX_QUEUE_DISK_BYTES.")
+
+// requestQueue holds request bodies until a background worker processes
+// them, in the order they arrived.
+type requestQueue interface {
+	enqueue(b queuedBody) error
+	depth() int
+	Stop()
+}
+
+// queuedBody is a request body along with what's needed to process it the
+// way it would have been processed straight away. Fluentd is the media type
+// of a body to be read as Fluentd entries.
+type queuedBody struct {
+	ID         string                 `json:"id"`
+	HeaderKeys []string               `json:"header_keys"`
+	Format     string                 `json:"format"`
+	Detected   bool                   `json:"detected,omitempty"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+	QuotaKey   string                 `json:"quota_key,omitempty"`
+	Presampled bool                   `json:"presampled,omitempty"`
+	Fluentd    string                 `json:"fluentd,omitempty"`
+	body       []byte
+}
+
+// queueRequest reads the body of a request and queues it for processing.
+func queueRequest(w http.ResponseWriter, r *http.Request) {
+
+	in := newIngest(r)
+	randPool.Put(in.rng)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		in.logf("queue error reading body %v\n", err)
+		writeError(w, http.StatusBadRequest, ErrorInvalidBody, fmt.Sprintf("error reading body %v", err))
+		return
+	}
+
+	b := queuedBody{
+		ID:         in.id,
+		HeaderKeys: in.headerKeys,
+		Format:     inputFormat,
+		Fields:     in.fields,
+		QuotaKey:   in.quotaKey,
+		Presampled: in.presampled,
+		body:       body,
+	}
+	if fluentdCompat && isFluentdRequest(r, bufio.NewReader(bytes.NewReader(body))) {
+		b.Fluentd = requestMediaType(r)
+	} else if autoDetectFormat {
+		if detected := detectInputFormat(bufio.NewReader(bytes.NewReader(body)), autoDetectBytes); detected != "" {
+			b.Format = detected
+		}
+		b.Detected = true
+	}
+
+	if err := queue.enqueue(b); err != nil {
+		in.logf("queue error %v\n", err)
+		writeError(w, http.StatusServiceUnavailable, ErrorServiceUnavailable, err.Error())
+		return
+	}
+	if vectorCompat {
+		writeVectorAck(w, r)
+		return
+	}
+	w.WriteHeader(successStatusCode)
+}
+
+// processQueued processes a body taken off the queue.
+func processQueued(b queuedBody) {
+
+	in := newHeaderIngest(func(string) []string { return nil })
+	in.headerKeys = b.HeaderKeys
+	in.fields = b.Fields
+	in.quotaKey = b.QuotaKey
+	in.presampled = b.Presampled
+	if b.ID != "" {
+		in.id = b.ID
+	}
+	if b.Fluentd != "" {
+		if err := readFluentdEntries(in, b.Fluentd, bytes.NewReader(b.body)); err != nil {
+			in.logf("%v\n", err)
+		}
+		in.finish()
+		return
+	}
+	if b.Detected {
+		in.format = b.Format
+	}
+	readInput(in, bytes.NewReader(b.body), b.Format)
+	in.finish()
+}
+
+// memoryQueue is a bounded in-memory queue. Anything still queued is lost if
+// the process dies.
+type memoryQueue struct {
+	mu      sync.Mutex
+	stopped bool
+	bodies  chan queuedBody
+	done    chan struct{}
+}
+
+func newMemoryQueue(size int) *memoryQueue {
+	q := &memoryQueue{
+		bodies: make(chan queuedBody, size),
+		done:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *memoryQueue) enqueue(b queuedBody) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return errQueueStopped
+	}
+	select {
+	case q.bodies <- b:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+func (q *memoryQueue) depth() int {
+	return len(q.bodies)
+}
+
+func (q *memoryQueue) run() {
+	for b := range q.bodies {
+		processQueued(b)
+	}
+	close(q.done)
+}
+
+// Stop processes everything already queued before returning.
+func (q *memoryQueue) Stop() {
+	q.mu.Lock()
+	q.stopped = true
+	close(q.bodies)
+	q.mu.Unlock()
+	<-q.done
+}
+
+// diskQueue writes each body to its own sequenced file in a directory before
+// acknowledging it, and processes the files in order. The sequence number of
+// the last processed file is kept in a cursor file, so after a crash the
+// files that were never processed are picked up again on start. A file is
+// only processed once every lower sequence number has been written or has
+// failed to be, so the cursor never passes a body that is still unprocessed.
+type diskQueue struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	pending  []queueSegment
+	writing  map[uint64]struct{}
+	bytes    int64
+	nextSeq  uint64
+	stopped  bool
+	ready    chan struct{}
+	stopping chan struct{}
+	done     chan struct{}
+}
+
+type queueSegment struct {
+	seq  uint64
+	size int64
+}
+
+// newDiskQueue opens the queue in dir, recovering any files left from a
+// previous run. maxBytes of 0 means no limit.
+func newDiskQueue(dir string, maxBytes int64) (*diskQueue, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &diskQueue{
+		dir:      dir,
+		maxBytes: maxBytes,
+		writing:  make(map[uint64]struct{}),
+		ready:    make(chan struct{}, 1),
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	cursor, err := q.readCursor()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	q.nextSeq = cursor + 1
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, queueFileSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq <= cursor {
+			// processed, but not removed before we stopped
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		q.pending = append(q.pending, queueSegment{seq: seq, size: info.Size()})
+		q.bytes += info.Size()
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(q.pending, func(i, j int) bool { return q.pending[i].seq < q.pending[j].seq })
+	if len(q.pending) > 0 {
+		fmt.Printf("Recovered %d queued request bodies from %s\n", len(q.pending), dir)
+		q.ready <- struct{}{}
+	}
+
+	go q.run()
+	return q, nil
+}
+
+func (q *diskQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, queueFileSuffix))
+}
+
+func (q *diskQueue) readCursor() (uint64, error) {
+	raw, err := os.ReadFile(filepath.Join(q.dir, queueCursorFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64)
+}
+
+// writeCursor records seq as processed, replacing the cursor file atomically.
+func (q *diskQueue) writeCursor(seq uint64) error {
+	tmp := filepath.Join(q.dir, queueCursorFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(q.dir, queueCursorFile))
+}
+
+// enqueue writes the body to disk and syncs it before returning, so an
+// acknowledged body survives a crash.
+func (q *diskQueue) enqueue(b queuedBody) error {
+
+	header, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return errQueueStopped
+	}
+	seq := q.nextSeq
+	q.nextSeq++
+	q.writing[seq] = struct{}{}
+	q.mu.Unlock()
+
+	tmp := q.path(seq) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(header, '\n'))
+	if err == nil {
+		_, err = f.Write(b.body)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, q.path(seq))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		q.mu.Lock()
+		delete(q.writing, seq)
+		q.mu.Unlock()
+		// later bodies may have been waiting on this one
+		q.signal()
+		return err
+	}
+	size := int64(len(header) + 1 + len(b.body))
+
+	q.mu.Lock()
+	delete(q.writing, seq)
+	q.pending = append(q.pending, queueSegment{seq: seq, size: size})
+	sort.Slice(q.pending, func(i, j int) bool { return q.pending[i].seq < q.pending[j].seq })
+	q.bytes += size
+	for q.maxBytes > 0 && q.bytes > q.maxBytes && len(q.pending) > 1 {
+		oldest := q.pending[0]
+		q.pending = q.pending[1:]
+		q.bytes -= oldest.size
+		os.Remove(q.path(oldest.seq))
+		queueDropped.Inc()
+		fmt.Printf("queue exceeds %d bytes, dropped queued body %d\n", q.maxBytes, oldest.seq)
+	}
+	q.mu.Unlock()
+
+	q.signal()
+	return nil
+}
+
+// signal wakes the worker if it is waiting for something to process.
+func (q *diskQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// nextReady returns the first pending segment if no lower sequence number is
+// still being written. It must be called with mu held.
+func (q *diskQueue) nextReady() (queueSegment, bool) {
+
+	if len(q.pending) == 0 {
+		return queueSegment{}, false
+	}
+	seg := q.pending[0]
+	for seq := range q.writing {
+		if seq < seg.seq {
+			return queueSegment{}, false
+		}
+	}
+	return seg, true
+}
+
+func (q *diskQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *diskQueue) run() {
+
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		seg, ok := q.nextReady()
+		if !ok {
+			q.mu.Unlock()
+			select {
+			case <-q.ready:
+				continue
+			case <-q.stopping:
+				return
+			}
+		}
+		q.pending = q.pending[1:]
+		q.bytes -= seg.size
+		q.mu.Unlock()
+
+		if err := q.process(seg.seq); err != nil {
+			fmt.Printf("queue error processing %s: %v\n", q.path(seg.seq), err)
+		}
+		if err := q.writeCursor(seg.seq); err != nil {
+			fmt.Printf("queue error writing cursor: %v\n", err)
+		}
+		os.Remove(q.path(seg.seq))
+
+		select {
+		case <-q.stopping:
+			return
+		default:
+		}
+	}
+}
+
+func (q *diskQueue) process(seq uint64) error {
+
+	raw, err := os.ReadFile(q.path(seq))
+	if err != nil {
+		return err
+	}
+	i := bytes.IndexByte(raw, '\n')
+	if i < 0 {
+		return errors.New("missing header")
+	}
+	var b queuedBody
+	if err := json.Unmarshal(raw[:i], &b); err != nil {
+		return err
+	}
+	b.body = raw[i+1:]
+	processQueued(b)
+	return nil
+}
+
+// Stop finishes the body being processed and leaves the rest on disk for the
+// next start.
+func (q *diskQueue) Stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.mu.Unlock()
+	close(q.stopping)
+	<-q.done
+}
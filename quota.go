@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// QuotaKeyHeader carries the API key a request's events are counted against.
+// Requests without it are counted against HONEYCOMB_API_KEY.
+const QuotaKeyHeader = "X-Honeycomb-Team"
+
+// DefaultQuotaMaxKeys is how many API keys get a quota bucket of their own.
+// Keys come from clients, so beyond this they share their rule's overflow
+// bucket rather than growing memory without limit.
+const DefaultQuotaMaxKeys = 10000
+
+var quotas *quotaManager
+
+var quotaExceeded = metrics.Counter("honeylog_quota_exceeded_total", "Kept events that were over their API key's quota and sampled harder.")
+
+// quotaRule limits the events kept for API keys matching Key, a glob pattern,
+// to EventsPerMinute. Burst is how many events may be kept at once above that
+// rate after a quiet spell; it defaults to a minute's worth.
+type quotaRule struct {
+	Key             string `yaml:"key"`
+	EventsPerMinute int    `yaml:"events_per_minute"`
+	Burst           int    `yaml:"burst"`
+}
+
+// quotaManager holds a token bucket for each API key that has matched a
+// quota rule, up to maxKeys of them. Buckets idle long enough to be no
+// different from new ones are dropped once a minute.
+type quotaManager struct {
+	rules      []quotaRule
+	defaultKey string
+	maxKeys    int
+
+	lock     sync.Mutex
+	buckets  map[string]*quotaBucket
+	overflow []*quotaBucket // by rule, shared by keys beyond maxKeys
+	swept    time.Time
+}
+
+// quotaBucket refills at its rule's rate up to its burst, and gives up a token
+// for each kept event. It also counts the kept events offered to it each
+// minute, to work out how much harder to sample once it runs dry.
+type quotaBucket struct {
+	lock        sync.Mutex
+	ruleIndex   int
+	rule        quotaRule
+	tokens      float64
+	refilled    time.Time
+	windowStart time.Time
+	seen        int
+	lastSeen    int
+}
+
+// loadQuotaRules reads a YAML list of quota rules. The first rule whose key
+// pattern matches an API key applies to it.
+func loadQuotaRules(file, defaultKey string, maxKeys int) (*quotaManager, error) {
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []quotaRule
+	if err := yaml.Unmarshal(raw, &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Key == "" {
+			return nil, fmt.Errorf("quota rule %d has no key", i+1)
+		}
+		if _, err := path.Match(rule.Key, ""); err != nil {
+			return nil, fmt.Errorf("quota rule %d: %v", i+1, err)
+		}
+		if rule.EventsPerMinute <= 0 {
+			return nil, fmt.Errorf("quota rule %d must have a positive events_per_minute", i+1)
+		}
+		if rule.Burst <= 0 {
+			rule.Burst = rule.EventsPerMinute
+		}
+	}
+	return &quotaManager{
+		rules:      rules,
+		defaultKey: defaultKey,
+		maxKeys:    maxKeys,
+		buckets:    make(map[string]*quotaBucket),
+		overflow:   make([]*quotaBucket, len(rules)),
+	}, nil
+}
+
+// apply takes a kept event's sample rate and counts the event against its API
+// key's quota. While the key is over quota, the event is only kept with a
+// further chance that shrinks as the key's traffic grows past its quota, and
+// its sample rate goes up to match, so the key keeps sending a representative
+// share of its events rather than none.
+func (q *quotaManager) apply(apiKey string, rate int, rng *rand.Rand) (int, bool) {
+
+	if q == nil {
+		return rate, true
+	}
+	if apiKey == "" {
+		apiKey = q.defaultKey
+	}
+	b := q.bucket(apiKey, time.Now())
+	if b == nil {
+		return rate, true
+	}
+	factor := b.take(time.Now())
+	if factor <= 1 {
+		return rate, true
+	}
+	quotaExceeded.Inc()
+	if rate > math.MaxInt32/factor {
+		return rate, false
+	}
+	return rate * factor, rng.Intn(factor) == 0
+}
+
+// bucket returns the bucket for an API key, starting one if the key has no
+// bucket yet, or nil if no rule matches it. Keys without a rule aren't
+// remembered, so clients can't fill memory with made up keys.
+func (q *quotaManager) bucket(apiKey string, now time.Time) *quotaBucket {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if b, ok := q.buckets[apiKey]; ok {
+		return b
+	}
+
+	for i, rule := range q.rules {
+		if ok, _ := path.Match(rule.Key, apiKey); !ok {
+			continue
+		}
+		if now.Sub(q.swept) >= time.Minute {
+			q.sweep(now)
+		}
+		if len(q.buckets) < q.maxKeys {
+			b := newQuotaBucket(i, rule, now)
+			q.buckets[apiKey] = b
+			return b
+		}
+		if q.overflow[i] == nil {
+			q.overflow[i] = newQuotaBucket(i, rule, now)
+		}
+		return q.overflow[i]
+	}
+	return nil
+}
+
+func newQuotaBucket(ruleIndex int, rule quotaRule, now time.Time) *quotaBucket {
+	return &quotaBucket{ruleIndex: ruleIndex, rule: rule, tokens: float64(rule.Burst), refilled: now, windowStart: now}
+}
+
+// sweep drops buckets that have refilled and forgotten their demand, as a new
+// bucket would start out. It must be called with lock held.
+func (q *quotaManager) sweep(now time.Time) {
+
+	q.swept = now
+	for key, b := range q.buckets {
+		if b.idle(now) {
+			delete(q.buckets, key)
+		}
+	}
+}
+
+// quotaRuleStats summarizes the buckets of one quota rule for /stats.
+type quotaRuleStats struct {
+	Key            string  `json:"key"`
+	Keys           int     `json:"keys"`
+	KeysOverQuota  int     `json:"keys_over_quota"`
+	MaxUtilization float64 `json:"max_utilization"`
+}
+
+// ruleStats reports the API keys each rule is tracking and how close the
+// busiest is to its quota. Keys themselves aren't shown.
+func (q *quotaManager) ruleStats(now time.Time) []quotaRuleStats {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	out := make([]quotaRuleStats, len(q.rules))
+	for i, rule := range q.rules {
+		out[i].Key = rule.Key
+	}
+	add := func(b *quotaBucket) {
+		u := b.utilization(now)
+		s := &out[b.ruleIndex]
+		s.Keys++
+		if u > 1 {
+			s.KeysOverQuota++
+		}
+		if u > s.MaxUtilization {
+			s.MaxUtilization = u
+		}
+	}
+	for _, b := range q.buckets {
+		add(b)
+	}
+	for _, b := range q.overflow {
+		if b != nil {
+			add(b)
+		}
+	}
+	return out
+}
+
+// take counts a kept event offered at now, and returns 1 if it fits in the
+// quota, or how many times harder events should be sampled if it doesn't.
+func (b *quotaBucket) take(now time.Time) int {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.tokens += now.Sub(b.refilled).Minutes() * float64(b.rule.EventsPerMinute)
+	if b.tokens > float64(b.rule.Burst) {
+		b.tokens = float64(b.rule.Burst)
+	}
+	b.refilled = now
+	b.advance(now)
+	b.seen++
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 1
+	}
+	demand := b.seen
+	if b.lastSeen > demand {
+		demand = b.lastSeen
+	}
+	factor := int(math.Ceil(float64(demand) / float64(b.rule.EventsPerMinute)))
+	if factor < 2 {
+		factor = 2
+	}
+	return factor
+}
+
+// advance starts a new counting window once a minute has passed.
+func (b *quotaBucket) advance(now time.Time) {
+
+	if elapsed := now.Sub(b.windowStart); elapsed >= time.Minute {
+		b.lastSeen = b.seen
+		if elapsed >= 2*time.Minute {
+			b.lastSeen = 0
+		}
+		b.seen = 0
+		b.windowStart = now
+	}
+}
+
+// idle reports whether the bucket has been left alone long enough to have
+// refilled completely and started counting demand afresh.
+func (b *quotaBucket) idle(now time.Time) bool {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	elapsed := now.Sub(b.refilled)
+	refill := time.Duration(float64(b.rule.Burst) / float64(b.rule.EventsPerMinute) * float64(time.Minute))
+	return elapsed >= 2*time.Minute && elapsed >= refill
+}
+
+// utilization is the share of the quota used by kept events offered in the
+// current minute, above 1 when the key is over its quota.
+func (b *quotaBucket) utilization(now time.Time) float64 {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.advance(now)
+	return float64(b.seen) / float64(b.rule.EventsPerMinute)
+}
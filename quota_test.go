@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testQuotas(t *testing.T, rules string, maxKeys int) *quotaManager {
+
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "quotas.yaml")
+	if err := os.WriteFile(file, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	q, err := loadQuotaRules(file, "default", maxKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestQuotaUnmatchedKeysNotTracked(t *testing.T) {
+
+	q := testQuotas(t, `[{key: "team-*", events_per_minute: 10}]`, DefaultQuotaMaxKeys)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		q.apply(fmt.Sprintf("other-%d", i), 1, rng)
+	}
+	if len(q.buckets) != 0 {
+		t.Errorf("tracking %d buckets for keys no rule matches", len(q.buckets))
+	}
+}
+
+func TestQuotaBucketsBounded(t *testing.T) {
+
+	q := testQuotas(t, `[{key: "*", events_per_minute: 10}]`, 5)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		q.apply(fmt.Sprintf("key-%d", i), 1, rng)
+	}
+	if len(q.buckets) != 5 {
+		t.Errorf("tracking %d buckets, want 5", len(q.buckets))
+	}
+	stats := q.ruleStats(time.Now())
+	if len(stats) != 1 || stats[0].Keys != 6 {
+		t.Errorf("rule stats = %+v, want 5 keys and the overflow bucket", stats)
+	}
+}
+
+func TestQuotaIdleBucketsDropped(t *testing.T) {
+
+	q := testQuotas(t, `[{key: "*", events_per_minute: 10}]`, DefaultQuotaMaxKeys)
+	start := time.Now()
+	q.bucket("old", start)
+	q.bucket("recent", start.Add(2*time.Minute))
+
+	q.bucket("new", start.Add(3*time.Minute))
+	if _, ok := q.buckets["old"]; ok {
+		t.Error("bucket idle for 3 minutes wasn't dropped")
+	}
+	if _, ok := q.buckets["recent"]; !ok {
+		t.Error("bucket idle for a minute was dropped")
+	}
+}
+
+func TestQuotaSkipsPriorityEvents(t *testing.T) {
+
+	defer func(q *quotaManager, field string, values map[string]bool) {
+		quotas, priorityBoostField, priorityBoostValues = q, field, values
+	}(quotas, priorityBoostField, priorityBoostValues)
+
+	quotas = testQuotas(t, `[{key: "*", events_per_minute: 1, burst: 1}]`, DefaultQuotaMaxKeys)
+	useTestSampler(t, 1, "level")
+	priorityBoostField, priorityBoostValues = "level", map[string]bool{"error": true}
+	sender := mockLibhoney(t)
+
+	in := newHeaderIngest(func(string) []string { return nil })
+	in.quotaKey = "team"
+	for i := 0; i < 50; i++ {
+		if err := in.sample(map[string]interface{}{"level": "error"}, time.Time{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in.finish()
+	if n := len(sender.Events()); n != 50 {
+		t.Errorf("sent %d of 50 priority events over quota, want all of them", n)
+	}
+}
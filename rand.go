@@ -0,0 +1,26 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// randPool hands each request handler its own random source for sampling
+// decisions, so concurrent requests don't contend on the global source's lock.
+var randPool = sync.Pool{
+	New: func() interface{} {
+		return newRand()
+	},
+}
+
+// newRand returns a random source seeded from crypto/rand.
+func newRand() *rand.Rand {
+	var seed int64
+	if err := binary.Read(crand.Reader, binary.LittleEndian, &seed); err != nil {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
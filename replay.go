@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Replay flags take precedence over the REPLAY_FILE, REPLAY_START_TIME and
+// REPLAY_END_TIME environment variables.
+var (
+	replayFlag          = flag.String("replay", "", "replay an NDJSON file of events and exit")
+	replayStartTimeFlag = flag.String("replay-start-time", "", "only replay events at or after this RFC3339 time")
+	replayEndTimeFlag   = flag.String("replay-end-time", "", "only replay events at or before this RFC3339 time")
+)
+
+// replayPath returns the file to replay, or an empty string when not
+// replaying.
+func replayPath() string {
+	return flagOrEnv(*replayFlag, "REPLAY_FILE")
+}
+
+// replayWindow limits a replay to events whose timestamp field falls within
+// it. A zero start or end leaves that side open.
+type replayWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+func (w replayWindow) contains(t time.Time) bool {
+	if w.start.IsZero() && w.end.IsZero() {
+		return true
+	}
+	if t.IsZero() {
+		return false
+	}
+	if !w.start.IsZero() && t.Before(w.start) {
+		return false
+	}
+	if !w.end.IsZero() && t.After(w.end) {
+		return false
+	}
+	return true
+}
+
+// newReplayWindow reads --replay-start-time and --replay-end-time, or
+// REPLAY_START_TIME and REPLAY_END_TIME, as RFC3339 timestamps.
+func newReplayWindow() (replayWindow, error) {
+
+	var w replayWindow
+	var err error
+	if s := flagOrEnv(*replayStartTimeFlag, "REPLAY_START_TIME"); s != "" {
+		if w.start, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return w, fmt.Errorf("invalid replay start time %q: %v", s, err)
+		}
+	}
+	if s := flagOrEnv(*replayEndTimeFlag, "REPLAY_END_TIME"); s != "" {
+		if w.end, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return w, fmt.Errorf("invalid replay end time %q: %v", s, err)
+		}
+	}
+	return w, nil
+}
+
+func flagOrEnv(value, name string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+// replayFile re-ingests an NDJSON file of events through the same cleanup
+// and sampling as events received over HTTP. Events keep the time in their
+// timestamp field, so a backfill lands where it originally happened. Gzipped
+// files are decompressed as they are read.
+func replayFile(path string, window replayWindow) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var body io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	in := newHeaderIngest(func(string) []string { return nil })
+
+	scanner := bufio.NewScanner(body)
+	buf := make([]byte, MaxLineLength)
+	scanner.Buffer(buf, MaxLineLength)
+
+	skipped := 0
+	for scanner.Scan() {
+		rawData := scanner.Bytes()
+		data := getEventMap()
+		err := unmarshalEvent(rawData, data)
+		if err != nil {
+			in.logf("json parsing error %v, raw data: %s\n", err, string(rawData))
+			in.total++
+			in.parseErrors++
+			putEventMap(data)
+			continue
+		}
+
+		timestamp := eventTimestamp(data)
+		if timestampField == "" {
+			timestamp = parseEventTime(data["timestamp"])
+		}
+		if !window.contains(timestamp) {
+			skipped++
+			putEventMap(data)
+			continue
+		}
+
+		in.total++
+		err = in.process(data, timestamp)
+		if err != nil {
+			in.logf("%v, raw data: %s\n", err, string(rawData))
+		}
+	}
+
+	in.finish()
+	fmt.Printf("Replayed %s, skipped %d events outside the time window.\n", path, skipped)
+	return scanner.Err()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// textResponse is implemented by response bodies that have a plain text form
+// for clients that ask for one.
+type textResponse interface {
+	Text() string
+}
+
+// ingestSummary is the response to a request that sent events, reporting
+// what happened to them.
+type ingestSummary struct {
+	Received   int   `json:"received"`
+	Sent       int   `json:"sent"`
+	Dropped    int   `json:"dropped"`
+	Errors     int   `json:"errors"`
+	DurationMS int64 `json:"duration_ms"`
+}
+
+func newIngestSummary(in *ingest) ingestSummary {
+	errors := in.parseErrors + in.sendErrors
+	dropped := in.total - in.success - errors
+	if dropped < 0 {
+		dropped = 0
+	}
+	return ingestSummary{
+		Received:   in.total,
+		Sent:       in.success,
+		Dropped:    dropped,
+		Errors:     errors,
+		DurationMS: time.Since(in.start).Milliseconds(),
+	}
+}
+
+func (s ingestSummary) Text() string {
+	return fmt.Sprintf("Received: %d, Sent: %d, Dropped: %d, Errors: %d (%dms)", s.Received, s.Sent, s.Dropped, s.Errors, s.DurationMS)
+}
+
+// writeResponse writes v with status as the response body. It is plain text
+// if v has a text form and the request's Accept header prefers text/plain to
+// JSON, and JSON otherwise. No body is written for 204 No Content.
+func writeResponse(w http.ResponseWriter, status int, v interface{}, r *http.Request) {
+
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	if t, ok := v.(textResponse); ok && prefersText(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprintln(w, t.Text())
+		return
+	}
+	writeJSONStatus(w, status, v, r)
+}
+
+// prefersText reports whether an Accept header ranks text/plain above
+// application/json. Ties, including a missing header and */*, go to JSON.
+func prefersText(accept string) bool {
+
+	var textQ, jsonQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(raw, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "text/plain", "text/*":
+			if q > textQ {
+				textQ = q
+			}
+		case "application/json", "application/*":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case "*/*":
+			if q > textQ {
+				textQ = q
+			}
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+	return textQ > jsonQ
+}
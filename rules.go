@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+var routingRules *RuleEngine
+
+var routingDropped = metrics.Counter("honeylog_routing_dropped_total", "Events dropped by a routing rule.")
+
+// RuleEngine applies an ordered list of routing rules to events. Every rule
+// whose match conditions an event meets contributes its actions, with later
+// rules overriding earlier ones, until a rule stops processing or drops the
+// event.
+type RuleEngine struct {
+	rules []routingRule
+}
+
+// routingRule is one entry of ROUTING_RULES_FILE. An empty match applies to
+// every event.
+type routingRule struct {
+	Match   map[string]string `yaml:"match"`
+	Actions ruleActions       `yaml:"actions"`
+}
+
+type ruleActions struct {
+	Dataset        string                 `yaml:"dataset"`
+	SampleRate     int                    `yaml:"sample_rate"`
+	Drop           bool                   `yaml:"drop"`
+	Tag            map[string]interface{} `yaml:"tag"`
+	StopProcessing bool                   `yaml:"stop_processing"`
+}
+
+// RuleResult is what the matching rules decided for an event. Zero values
+// leave the decision to the rest of the pipeline.
+type RuleResult struct {
+	Dataset    string
+	SampleRate int
+	Drop       bool
+	Tags       map[string]interface{}
+}
+
+// loadRuleEngine reads a YAML list of routing rules.
+func loadRuleEngine(path string) (*RuleEngine, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []routingRule
+	if err := yaml.Unmarshal(raw, &rules); err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if rule.Actions.SampleRate < 0 {
+			return nil, fmt.Errorf("routing rule %d has a negative sample_rate", i+1)
+		}
+	}
+	return &RuleEngine{rules: rules}, nil
+}
+
+// Evaluate runs an event through the rules in order and returns the combined
+// result of those it matches.
+func (e *RuleEngine) Evaluate(data map[string]interface{}) RuleResult {
+
+	var result RuleResult
+	for _, rule := range e.rules {
+		if !rule.matches(data) {
+			continue
+		}
+		a := rule.Actions
+		if a.Dataset != "" {
+			result.Dataset = a.Dataset
+		}
+		if a.SampleRate > 0 {
+			result.SampleRate = a.SampleRate
+		}
+		for k, v := range a.Tag {
+			if result.Tags == nil {
+				result.Tags = make(map[string]interface{})
+			}
+			result.Tags[k] = v
+		}
+		if a.Drop {
+			result.Drop = true
+			return result
+		}
+		if a.StopProcessing {
+			break
+		}
+	}
+	return result
+}
+
+func (r *routingRule) matches(data map[string]interface{}) bool {
+	for field, value := range r.Match {
+		v, ok := data[field]
+		if !ok || fmt.Sprintf("%v", v) != value {
+			return false
+		}
+	}
+	return true
+}
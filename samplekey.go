@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DefaultFieldNamespace = "event"
+
+var normalizeSamplingKeys bool
+
+// fieldNamespace prefixes the metadata fields honeylog adds to events, such
+// as event.samplekey.
+var fieldNamespace = DefaultFieldNamespace
+
+// metaField names a metadata field in fieldNamespace.
+func metaField(name string) string {
+	return fieldNamespace + "." + name
+}
+
+// structuralSampling keys events by their schema rather than the values of
+// sampling fields.
+var structuralSampling bool
+
+// schemaFingerprint is the sorted, comma separated field names of an event,
+// so events with the same fields share a sampling key whatever their values.
+func schemaFingerprint(data map[string]interface{}) string {
+
+	names := make([]string, 0, len(data))
+	for k := range data {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// samplingKeyValue renders a field value for use in a sampling key. When
+// normalization is enabled, numbers and booleans get a canonical form whether
+// they arrived as JSON values or as strings, so 200 and "200" share a key.
+// Numeric readings win, so "1" stays a number rather than becoming true.
+func samplingKeyValue(val interface{}) string {
+
+	if !normalizeSamplingKeys {
+		return fmt.Sprintf("%v", val)
+	}
+
+	switch v := val.(type) {
+	case string:
+		s := strings.TrimSpace(v)
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		if b, err := strconv.ParseBool(s); err == nil {
+			return strconv.FormatBool(b)
+		}
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatFloat(float64(rv.Int()), 'g', -1, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatFloat(float64(rv.Uint()), 'g', -1, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(rv.Float(), 'g', -1, 64)
+	}
+	return fmt.Sprintf("%v", val)
+}
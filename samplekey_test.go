@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSamplingKeyValueNormalized(t *testing.T) {
+
+	defer func(normalize bool) { normalizeSamplingKeys = normalize }(normalizeSamplingKeys)
+	normalizeSamplingKeys = true
+
+	tests := []struct {
+		name string
+		val  interface{}
+		want string
+	}{
+		{"json number", float64(200), "200"},
+		{"numeric string", "200", "200"},
+		{"padded numeric string", " 200 ", "200"},
+		{"int", 200, "200"},
+		{"int64", int64(200), "200"},
+		{"float string", "1.50", "1.5"},
+		{"exponent string", "2e2", "200"},
+		{"bool", true, "true"},
+		{"bool string", "true", "true"},
+		{"capitalized bool string", "True", "true"},
+		{"false string", "FALSE", "false"},
+		// numeric readings win, so "1" and 1 share a key with each other
+		// rather than with true
+		{"one string", "1", "1"},
+		{"one", float64(1), "1"},
+		{"zero string", "0", "0"},
+		{"other string", "GET", "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := samplingKeyValue(tt.val); got != tt.want {
+				t.Errorf("samplingKeyValue(%#v) = %q, want %q", tt.val, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSamplingKeyValueNotNormalized(t *testing.T) {
+
+	defer func(normalize bool) { normalizeSamplingKeys = normalize }(normalizeSamplingKeys)
+	normalizeSamplingKeys = false
+
+	tests := []struct {
+		val  interface{}
+		want string
+	}{
+		{float64(200), "200"},
+		{"200.0", "200.0"},
+		{"True", "True"},
+	}
+	for _, tt := range tests {
+		if got := samplingKeyValue(tt.val); got != tt.want {
+			t.Errorf("samplingKeyValue(%#v) = %q, want %q", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestSamplingKeyJSONNumberMatchesString(t *testing.T) {
+
+	defer func(normalize bool, fields []string) {
+		normalizeSamplingKeys, samplingFields = normalize, fields
+	}(normalizeSamplingKeys, samplingFields)
+	samplingFields = []string{"service", "status"}
+
+	key := func(raw string) string {
+		var data map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &data); err != nil {
+			t.Fatal(err)
+		}
+		return samplingKey(data, nil)
+	}
+	number := `{"service":"api","status":200}`
+	str := `{"service":"api","status":"200"}`
+
+	normalizeSamplingKeys = true
+	if a, b := key(number), key(str); a != b {
+		t.Errorf("normalized keys differ: %q and %q", a, b)
+	}
+
+	normalizeSamplingKeys = false
+	if a, b := key(`{"service":"api","status":true}`), key(`{"service":"api","status":"True"}`); a == b {
+		t.Errorf("keys should differ without normalization, both %q", a)
+	}
+}
+
+func TestMetaFieldNamespace(t *testing.T) {
+
+	defer func(ns string) { fieldNamespace = ns }(fieldNamespace)
+
+	tests := []struct {
+		namespace string
+		want      string
+	}{
+		{DefaultFieldNamespace, "event.samplekey"},
+		{"honeylog", "honeylog.samplekey"},
+		{"meta.hl", "meta.hl.samplekey"},
+	}
+	for _, tt := range tests {
+		fieldNamespace = tt.namespace
+		if got := metaField("samplekey"); got != tt.want {
+			t.Errorf("metaField with namespace %q = %q, want %q", tt.namespace, got, tt.want)
+		}
+	}
+}
+
+func TestSentEventsUseFieldNamespace(t *testing.T) {
+
+	defer func(ns string) { fieldNamespace = ns }(fieldNamespace)
+	fieldNamespace = "honeylog"
+	sender := mockLibhoney(t)
+
+	e := keptEvent{data: map[string]interface{}{"service": "a"}, rate: 3, key: "a"}
+	if err := sendEventTo(nil, e, ""); err != nil {
+		t.Fatal(err)
+	}
+	events := sender.Events()
+	if len(events) != 1 {
+		t.Fatalf("sent %d events, want 1", len(events))
+	}
+	if events[0].Data["honeylog.samplekey"] != "a" {
+		t.Errorf("honeylog.samplekey = %v, want a", events[0].Data["honeylog.samplekey"])
+	}
+	for k := range events[0].Data {
+		if strings.HasPrefix(k, "event.") {
+			t.Errorf("sent event has %s outside the configured namespace", k)
+		}
+	}
+
+	body, err := encodeKeptEvents([]keptEvent{e})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `"honeylog.samplekey":"a"`) || !strings.Contains(string(body), `"honeylog.samplerate":3`) {
+		t.Errorf("upstream body doesn't use the namespace: %s", body)
+	}
+}
+
+// TestNoHardcodedEventNamespace guards against metadata fields being named
+// with a literal "event." prefix instead of through metaField.
+func TestNoHardcodedEventNamespace(t *testing.T) {
+
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			lit, ok := n.(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+			if s, err := strconv.Unquote(lit.Value); err == nil && strings.HasPrefix(s, "event.") {
+				t.Errorf("%s: hardcoded %q, use metaField", fset.Position(lit.Pos()), s)
+			}
+			return true
+		})
+	}
+}
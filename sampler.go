@@ -0,0 +1,197 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/dynsampler-go"
+)
+
+const OverflowSampleKey = "__overflow__"
+
+// minSampleRate and maxSampleRate bound the rates samplers choose. A
+// maxSampleRate of 0 means no limit.
+var minSampleRate = 1
+var maxSampleRate int
+
+// clampSampleRate bounds a sampler's rate by minSampleRate and maxSampleRate,
+// so bursts can't make sampling more aggressive than an operator allows.
+func clampSampleRate(rate int) int {
+	if maxSampleRate > 0 && rate > maxSampleRate {
+		rate = maxSampleRate
+	}
+	if rate < minSampleRate {
+		rate = minSampleRate
+	}
+	return rate
+}
+
+// keyLimitedSampler wraps the EMA sampler to cap how many distinct sampling
+// keys it tracks. Once the cap is reached, new keys either share an overflow
+// bucket sampled at the goal rate, or evict an existing key when an eviction
+// policy is configured. Evicted keys are no longer fed to the EMA sampler and
+// age out of it on their own. The EMA sampler should be given the same cap as
+// its MaxKeys, which bounds its own maps, since keys linger there after they
+// are evicted.
+type keyLimitedSampler struct {
+	emaLock  sync.RWMutex
+	ema      *dynsampler.EMASampleRate
+	maxKeys  int
+	eviction string
+
+	lock  sync.Mutex
+	keys  map[string]*list.Element
+	order *list.List
+
+	// counts of events seen per key since windowStart, reset once per EMA
+	// adjustment interval
+	countLock   sync.Mutex
+	window      time.Duration
+	windowStart time.Time
+	counts      map[string]int
+}
+
+func newKeyLimitedSampler(ema *dynsampler.EMASampleRate, maxKeys int, eviction string) (*keyLimitedSampler, error) {
+
+	switch eviction {
+	case "", "lru", "oldest", "random":
+	default:
+		return nil, fmt.Errorf("unknown sampler key eviction policy %q", eviction)
+	}
+
+	return &keyLimitedSampler{
+		ema:         ema,
+		maxKeys:     maxKeys,
+		eviction:    eviction,
+		keys:        make(map[string]*list.Element),
+		order:       list.New(),
+		window:      time.Duration(ema.AdjustmentInterval) * time.Second,
+		windowStart: time.Now(),
+		counts:      make(map[string]int),
+	}, nil
+}
+
+// current returns the EMA sampler in use.
+func (s *keyLimitedSampler) current() *dynsampler.EMASampleRate {
+	s.emaLock.RLock()
+	defer s.emaLock.RUnlock()
+	return s.ema
+}
+
+// GoalSampleRate returns the rate the EMA sampler is aiming for.
+func (s *keyLimitedSampler) GoalSampleRate() int {
+	return s.current().GoalSampleRate
+}
+
+// SetGoalSampleRate replaces the EMA sampler with one aiming for rate,
+// carrying over the moving averages learned so far. The EMA sampler can't be
+// stopped, so the one replaced keeps ticking idle in the background; rates
+// should only be changed by an operator, not per event.
+func (s *keyLimitedSampler) SetGoalSampleRate(rate int) error {
+
+	s.emaLock.Lock()
+	defer s.emaLock.Unlock()
+	if rate == s.ema.GoalSampleRate {
+		return nil
+	}
+	state, err := s.ema.SaveState()
+	if err != nil {
+		return err
+	}
+	ema := &dynsampler.EMASampleRate{
+		GoalSampleRate:     rate,
+		AdjustmentInterval: s.ema.AdjustmentInterval,
+		MaxKeys:            s.ema.MaxKeys,
+	}
+	if err := ema.LoadState(state); err != nil {
+		return err
+	}
+	if err := ema.Start(); err != nil {
+		return err
+	}
+	s.ema = ema
+	return nil
+}
+
+// GetSampleRate returns the sample rate for key, along with the key the rate
+// was actually determined for.
+func (s *keyLimitedSampler) GetSampleRate(key string) (int, string) {
+
+	ema := s.current()
+	if s.maxKeys <= 0 {
+		return ema.GetSampleRate(key), key
+	}
+
+	s.lock.Lock()
+	if el, ok := s.keys[key]; ok {
+		if s.eviction == "lru" {
+			s.order.MoveToFront(el)
+		}
+	} else {
+		if len(s.keys) >= s.maxKeys {
+			if s.eviction == "" {
+				s.lock.Unlock()
+				return ema.GoalSampleRate, OverflowSampleKey
+			}
+			s.evict()
+		}
+		s.keys[key] = s.order.PushFront(key)
+	}
+	s.lock.Unlock()
+
+	return ema.GetSampleRate(key), key
+}
+
+// evict drops one tracked key according to the eviction policy. The lock
+// must be held.
+func (s *keyLimitedSampler) evict() {
+
+	if s.eviction == "random" {
+		// map iteration order is randomized, which is good enough here
+		for key, el := range s.keys {
+			s.order.Remove(el)
+			delete(s.keys, key)
+			return
+		}
+	}
+
+	el := s.order.Back()
+	s.order.Remove(el)
+	delete(s.keys, el.Value.(string))
+}
+
+// ActiveKeys returns the number of sampling keys the EMA sampler holds a
+// moving average for, including evicted keys that haven't aged out yet.
+func (s *keyLimitedSampler) ActiveKeys() int {
+
+	raw, err := s.current().SaveState()
+	if err != nil {
+		return 0
+	}
+	var state struct {
+		MovingAverage map[string]float64 `json:"moving_average"`
+	}
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return 0
+	}
+	return len(state.MovingAverage)
+}
+
+// Count records an event for key and returns how many events have been seen
+// for it in the current window. The window follows the EMA sampler's
+// adjustment interval but isn't synchronized with it, so the count is
+// approximate.
+func (s *keyLimitedSampler) Count(key string) int {
+
+	s.countLock.Lock()
+	defer s.countLock.Unlock()
+	if now := time.Now(); now.Sub(s.windowStart) >= s.window {
+		s.windowStart = now
+		s.counts = make(map[string]int)
+	}
+	s.counts[key]++
+	return s.counts[key]
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/honeycombio/dynsampler-go"
+)
+
+// useTestSampler swaps in a started EMA sampler aiming for goal, along with
+// the sampling fields, for the length of a test or benchmark.
+func useTestSampler(tb testing.TB, goal int, fields ...string) {
+
+	tb.Helper()
+	ema := &dynsampler.EMASampleRate{GoalSampleRate: goal}
+	if err := ema.Start(); err != nil {
+		tb.Fatal(err)
+	}
+	s, err := newKeyLimitedSampler(ema, 0, "")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	prevSampler, prevFields := sampler, samplingFields
+	tb.Cleanup(func() { sampler, samplingFields = prevSampler, prevFields })
+	sampler, samplingFields = s, fields
+}
+
+func TestClampSampleRate(t *testing.T) {
+
+	defer func(min, max int) { minSampleRate, maxSampleRate = min, max }(minSampleRate, maxSampleRate)
+
+	tests := []struct {
+		name     string
+		min, max int
+		rate     int
+		want     int
+	}{
+		{"defaults leave the rate alone", 1, 0, 5000, 5000},
+		{"over the ceiling", 1, 500, 5000, 500},
+		{"at the ceiling", 1, 500, 500, 500},
+		{"under the ceiling", 1, 500, 20, 20},
+		{"under the floor", 10, 0, 2, 10},
+		{"at the floor", 10, 0, 10, 10},
+		{"between floor and ceiling", 10, 500, 100, 100},
+		{"floor and ceiling equal", 50, 50, 1, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			minSampleRate, maxSampleRate = tt.min, tt.max
+			if got := clampSampleRate(tt.rate); got != tt.want {
+				t.Errorf("clampSampleRate(%d) with min %d, max %d = %d, want %d", tt.rate, tt.min, tt.max, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetermineSampleRateClampsSamplerRate(t *testing.T) {
+
+	defer func(s *keyLimitedSampler, min, max int, fields []string) {
+		sampler, minSampleRate, maxSampleRate, samplingFields = s, min, max, fields
+	}(sampler, minSampleRate, maxSampleRate, samplingFields)
+
+	// with its only key slot taken, the sampler gives every new key the goal
+	// rate, standing in for an EMA that has settled on 5000
+	s, err := newKeyLimitedSampler(&dynsampler.EMASampleRate{GoalSampleRate: 5000, AdjustmentInterval: 15}, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.keys["taken"] = s.order.PushFront("taken")
+	sampler = s
+	samplingFields = []string{"service"}
+	minSampleRate, maxSampleRate = 1, 500
+
+	rate, _, _ := determineSampleRate(map[string]interface{}{"service": "burst"}, nil, 0, newRand())
+	if rate != 500 {
+		t.Errorf("rate = %d, want the sampler's 5000 clamped to 500", rate)
+	}
+
+	maxSampleRate = 0
+	rate, _, _ = determineSampleRate(map[string]interface{}{"service": "burst"}, nil, 0, newRand())
+	if rate != 5000 {
+		t.Errorf("rate = %d, want 5000 without a ceiling", rate)
+	}
+}
+
+func TestSetGoalSampleRateKeepsAverages(t *testing.T) {
+
+	ema := &dynsampler.EMASampleRate{GoalSampleRate: 10}
+	if err := ema.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ema.LoadState([]byte(`{"saved_sample_rates":{"a":10},"moving_average":{"a":100}}`)); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newKeyLimitedSampler(ema, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetGoalSampleRate(50); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GoalSampleRate(); got != 50 {
+		t.Errorf("goal rate = %d, want 50", got)
+	}
+	if got := s.ActiveKeys(); got != 1 {
+		t.Errorf("active keys = %d, want the 1 carried over", got)
+	}
+	if rate, _ := s.GetSampleRate("a"); rate != 10 {
+		t.Errorf("rate for a = %d, want 10 until the next adjustment", rate)
+	}
+}
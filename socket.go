@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const DefaultUnixSocketMode = 0660
+
+// listenUnixSocket opens a Unix domain socket at path with the given file
+// permissions. A socket file left behind by an instance that crashed is
+// removed first, but we refuse to take over a socket another process is
+// still serving on.
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket %s: %v", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// removeUnixSocket cleans up the socket file on shutdown.
+func removeUnixSocket(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("error removing unix socket %s: %v\n", path, err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var startTime = time.Now()
+
+var (
+	linesReceived = metrics.Counter("honeylog_lines_received_total", "Input lines received.")
+	eventsSent    = metrics.Counter("honeylog_events_sent_total", "Events sent after sampling.")
+	parseErrors   = metrics.Counter("honeylog_parse_errors_total", "Input lines that failed to parse.")
+)
+
+var stats = &statsRegistry{values: make(map[string]func() interface{})}
+
+// statsRegistry holds the values reported on /stats. Each value is read when
+// the endpoint is requested.
+type statsRegistry struct {
+	lock   sync.Mutex
+	values map[string]func() interface{}
+}
+
+// Register adds a named value to /stats.
+func (s *statsRegistry) Register(name string, fn func() interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.values[name] = fn
+}
+
+func serveStats(w http.ResponseWriter, r *http.Request) {
+
+	stats.lock.Lock()
+	out := make(map[string]interface{}, len(stats.values)+4)
+	for name, fn := range stats.values {
+		out[name] = fn()
+	}
+	stats.lock.Unlock()
+
+	out["uptime_seconds"] = int64(time.Since(startTime).Seconds())
+	out["lines_received"] = linesReceived.Value()
+	out["events_sent"] = eventsSent.Value()
+	out["parse_errors"] = parseErrors.Value()
+
+	writeJSON(w, out, r)
+}
+
+// writeJSON writes v as the JSON response body, indented for readability when
+// the request has a truthy pretty query parameter.
+func writeJSON(w http.ResponseWriter, v interface{}, r *http.Request) {
+	writeJSONStatus(w, http.StatusOK, v, r)
+}
+
+// writeJSONStatus is writeJSON responding with status.
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}, r *http.Request) {
+
+	var body []byte
+	var err error
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); pretty {
+		body, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrorInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+var streamingDecode bool
+
+// readJSONStream decodes events straight off the request body with a
+// json.Decoder instead of splitting it into lines first. The limited reader is
+// topped back up after every event so MaxLineLength applies per event rather
+// than to the whole body. Unlike line scanning, the decoder cannot resync after
+// malformed input, so the rest of the body is abandoned on a parse error.
+func readJSONStream(in *ingest, body io.Reader) {
+
+	limited := &io.LimitedReader{R: body, N: MaxLineLength}
+	dec := json.NewDecoder(limited)
+
+	for {
+		data := getEventMap()
+		// repeated keys can only be seen in the raw event
+		var raw json.RawMessage
+		var err error
+		if duplicateKeyPolicy == DuplicateKeyLast {
+			err = dec.Decode(&data)
+		} else {
+			err = dec.Decode(&raw)
+		}
+		if err == io.EOF {
+			putEventMap(data)
+			return
+		}
+		in.total++
+		if err != nil {
+			in.parseErrors++
+			putEventMap(data)
+			if limited.N <= 0 {
+				in.logf("json parsing error event exceeds %d bytes, abandoning remaining body\n", MaxLineLength)
+				return
+			}
+			in.logf("json parsing error %v, abandoning remaining body\n", err)
+			return
+		}
+		limited.N = MaxLineLength
+
+		// null decodes to a nil map, which can't be written to
+		if data == nil {
+			in.parseErrors++
+			in.logf("json parsing error event is null, not an object\n")
+			continue
+		}
+
+		// the decoder is still in step after the raw event, so only the event
+		// is lost if its keys can't be resolved
+		if raw != nil {
+			if err := unmarshalEvent(raw, data); err != nil {
+				in.parseErrors++
+				putEventMap(data)
+				in.logf("json parsing error %v, raw data: %s\n", err, string(raw))
+				continue
+			}
+		}
+
+		err = in.process(data, eventTimestamp(data))
+		if err != nil {
+			in.logf("%v\n", err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// benchmarkBody returns count newline delimited events of the given number
+// of fields, each value valueLen bytes long.
+func benchmarkBody(b *testing.B, count, fields, valueLen int) []byte {
+
+	event := map[string]interface{}{"service": "api"}
+	for i := 0; i < fields; i++ {
+		event[fmt.Sprintf("field_%d", i)] = strings.Repeat("x", valueLen)
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var body bytes.Buffer
+	for i := 0; i < count; i++ {
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+	return body.Bytes()
+}
+
+func benchmarkReader(b *testing.B, read func(*ingest, io.Reader)) {
+
+	useTestSampler(b, 1, "service")
+	discardLibhoney(b)
+
+	// every request logs a summary, which would bury the results
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer devNull.Close()
+	defer func(stdout *os.File) { os.Stdout = stdout }(os.Stdout)
+	os.Stdout = devNull
+
+	sizes := []struct {
+		name     string
+		fields   int
+		valueLen int
+	}{
+		{"small", 5, 16},
+		{"medium", 50, 64},
+		{"large", 40, 1024},
+	}
+	for _, size := range sizes {
+		b.Run(size.name, func(b *testing.B) {
+			body := benchmarkBody(b, 100, size.fields, size.valueLen)
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				in := newHeaderIngest(func(string) []string { return nil })
+				read(in, bytes.NewReader(body))
+				in.finish()
+				if in.parseErrors != 0 {
+					b.Fatalf("%d parse errors", in.parseErrors)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadJSONLines reads events a line at a time with a scanner.
+func BenchmarkReadJSONLines(b *testing.B) {
+	benchmarkReader(b, readJSONLines)
+}
+
+// BenchmarkReadJSONStream reads events with a streaming JSON decoder.
+func BenchmarkReadJSONStream(b *testing.B) {
+	benchmarkReader(b, readJSONStream)
+}
+
+func TestReadJSONStreamNullEvent(t *testing.T) {
+
+	in := newHeaderIngest(func(string) []string { return nil })
+	readJSONStream(in, strings.NewReader("null\nnull\n"))
+	if in.total != 2 || in.parseErrors != 2 {
+		t.Errorf("total = %d, parse errors = %d, want 2 and 2", in.total, in.parseErrors)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+var fieldTemplates []fieldTemplate
+
+// datasetTemplate names the dataset of each event from its fields, if set.
+var datasetTemplate *template.Template
+
+// fieldTemplate computes the value of field from the other fields of an event.
+type fieldTemplate struct {
+	field string
+	tmpl  *template.Template
+}
+
+// loadFieldTemplates reads a YAML mapping of field names to text/template
+// expressions. Templates are applied in the order they appear in the file, so
+// later ones can build on fields produced by earlier ones.
+func loadFieldTemplates(path string) ([]fieldTemplate, error) {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s must contain a mapping of field names to templates", path)
+	}
+
+	var templates []fieldTemplate
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		field := root.Content[i].Value
+		tmpl, err := template.New(field).Option("missingkey=zero").Parse(root.Content[i+1].Value)
+		if err != nil {
+			return nil, fmt.Errorf("template for field %s: %v", field, err)
+		}
+		templates = append(templates, fieldTemplate{field: field, tmpl: tmpl})
+	}
+	return templates, nil
+}
+
+// applyFieldTemplates sets each templated field on the event. A template that
+// fails on an event is logged and its field skipped; the event is kept. An
+// error is returned if a field collides with an existing one under the error
+// collision policy.
+func applyFieldTemplates(data map[string]interface{}) error {
+
+	if len(fieldTemplates) == 0 {
+		return nil
+	}
+
+	ctx := templateContext(data)
+	var buf bytes.Buffer
+	for _, ft := range fieldTemplates {
+		buf.Reset()
+		if err := ft.tmpl.Execute(&buf, ctx); err != nil {
+			fmt.Printf("field template error for %s: %v\n", ft.field, err)
+			continue
+		}
+		key, err := injectField(data, ft.field, buf.String())
+		if err != nil {
+			return err
+		}
+		if key != "" {
+			ctx[key] = data[key]
+		}
+	}
+	return nil
+}
+
+// templateContext copies the event for use as template data. JSON numbers
+// decode as floats, so whole numbers are presented as integers to let
+// templates compare them against integer constants like 500.
+func templateContext(data map[string]interface{}) map[string]interface{} {
+
+	ctx := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			v = int64(f)
+		}
+		ctx[k] = v
+	}
+	return ctx
+}
+
+// expandDatasetName evaluates a dataset name given as a template against the
+// environment, so HONEYCOMB_DATASET=mylogs-{{.ENVIRONMENT}} names a dataset
+// per environment. Referring to an unset variable is an error. Names that
+// aren't templates are returned as they are.
+func expandDatasetName(name string) (string, error) {
+
+	if !strings.Contains(name, "{{") {
+		return name, nil
+	}
+	tmpl, err := template.New("dataset").Option("missingkey=error").Parse(name)
+	if err != nil {
+		return "", err
+	}
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, env); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// parseDatasetTemplate parses a template naming the dataset of each event
+// from its fields, such as {{.service}}-logs. It returns nil if raw is empty.
+func parseDatasetTemplate(raw string) (*template.Template, error) {
+
+	if raw == "" {
+		return nil, nil
+	}
+	return template.New("dataset").Option("missingkey=zero").Parse(raw)
+}
+
+// eventDataset evaluates datasetTemplate against an event. An empty result,
+// or a template that fails on the event, leaves the event in the default
+// dataset.
+func eventDataset(data map[string]interface{}) string {
+
+	if datasetTemplate == nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	if err := datasetTemplate.Execute(&buf, templateContext(data)); err != nil {
+		fmt.Printf("dataset template error: %v\n", err)
+		return ""
+	}
+	return buf.String()
+}
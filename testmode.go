@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const DefaultTestResponseDelayHeader = "X-Honeylog-Delay-Ms"
+
+// delayResponses wraps a handler so responses to requests carrying header
+// are held for that many milliseconds after the request has been handled,
+// letting end-to-end tests trigger client timeouts on requests whose events
+// were already processed. It is only installed in TEST_MODE. A delay is cut
+// short, and the response dropped, if the client goes away.
+func delayResponses(next http.Handler, header string) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms, err := strconv.Atoi(r.Header.Get(header))
+		if err != nil || ms <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffered := &bufferedResponse{header: w.Header()}
+		next.ServeHTTP(buffered, r)
+		timer := time.NewTimer(time.Duration(ms) * time.Millisecond)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		}
+		if buffered.status != 0 {
+			w.WriteHeader(buffered.status)
+		}
+		w.Write(buffered.body.Bytes())
+	})
+}
+
+// bufferedResponse holds a response in memory until it is written out.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDelayResponsesHandlesBeforeDelaying(t *testing.T) {
+
+	var handled time.Time
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled = time.Now()
+		w.Header().Set("X-Handled", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("ok"))
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(DefaultTestResponseDelayHeader, "50")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	delayResponses(next, DefaultTestResponseDelayHeader).ServeHTTP(w, r)
+
+	if handled.Sub(start) >= 50*time.Millisecond {
+		t.Errorf("request was handled %v after it arrived, want before the delay", handled.Sub(start))
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("response was written after %v, want at least 50ms", elapsed)
+	}
+	if w.Code != http.StatusAccepted || w.Body.String() != "ok" || w.Header().Get("X-Handled") != "yes" {
+		t.Errorf("response = %d %q with X-Handled %q, want the handler's", w.Code, w.Body.String(), w.Header().Get("X-Handled"))
+	}
+}
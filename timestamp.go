@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	PrecisionAuto         = "auto"
+	PrecisionSeconds      = "s"
+	PrecisionMilliseconds = "ms"
+	PrecisionMicroseconds = "us"
+)
+
+var timestampField string
+var timestampPrecision = PrecisionAuto
+var timestampPrecisionWarning bool
+
+// precisionWarned holds the precisions a suspect guess has already been
+// logged for, since a bad guess is usually repeated for every event.
+var precisionWarned sync.Map
+
+var precisionWarnings = metrics.Counter("honeylog_timestamp_precision_warnings_total", "Unix timestamps whose auto guessed precision gave a time outside 2000-2099.")
+
+// validTimestampPrecision reports whether precision is one TIMESTAMP_PRECISION
+// accepts.
+func validTimestampPrecision(precision string) bool {
+	switch precision {
+	case PrecisionAuto, PrecisionSeconds, PrecisionMilliseconds, PrecisionMicroseconds:
+		return true
+	}
+	return false
+}
+
+// eventTimestamp returns the time an event happened from its timestamp
+// field, or the zero time if it doesn't have a usable one. The field is
+// TIMESTAMP_FIELD, or the timestamp field Vector adds when in Vector
+// compatibility mode.
+func eventTimestamp(data map[string]interface{}) time.Time {
+
+	field := timestampField
+	if field == "" {
+		if !vectorCompat {
+			return time.Time{}
+		}
+		field = "timestamp"
+	}
+	return parseEventTime(data[field])
+}
+
+// parseEventTime reads an RFC3339 string or a unix timestamp number.
+func parseEventTime(val interface{}) time.Time {
+
+	if s, ok := val.(string); ok {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return time.Time{}
+		}
+		return t
+	}
+	if f, ok := numericValue(val); ok && f > 0 {
+		return unixTime(f)
+	}
+	return time.Time{}
+}
+
+// unixTime converts a unix timestamp in the configured precision. In auto
+// mode the precision is guessed from the magnitude: anything past 1e15 is
+// microseconds, past 1e12 milliseconds, and seconds otherwise.
+func unixTime(f float64) time.Time {
+
+	precision := timestampPrecision
+	if precision == PrecisionAuto {
+		switch {
+		case f > 1e15:
+			precision = PrecisionMicroseconds
+		case f > 1e12:
+			precision = PrecisionMilliseconds
+		default:
+			precision = PrecisionSeconds
+		}
+	}
+
+	var t time.Time
+	switch precision {
+	case PrecisionMicroseconds:
+		t = time.Unix(0, int64(f*1e3))
+	case PrecisionMilliseconds:
+		t = time.Unix(0, int64(f*1e6))
+	default:
+		sec, frac := math.Modf(f)
+		t = time.Unix(int64(sec), int64(frac*1e9))
+	}
+
+	// a guess that lands outside this century was probably the wrong one
+	if timestampPrecisionWarning && timestampPrecision == PrecisionAuto && (t.Year() < 2000 || t.Year() >= 2100) {
+		precisionWarnings.Inc()
+		if _, warned := precisionWarned.LoadOrStore(precision, true); !warned {
+			fmt.Printf("warning: guessed unix timestamp %v is in %s, giving %v; further guesses like it are only counted in honeylog_timestamp_precision_warnings_total\n", f, precisionName(precision), t.UTC())
+		}
+	}
+	return t
+}
+
+func precisionName(precision string) string {
+	switch precision {
+	case PrecisionMicroseconds:
+		return "microseconds"
+	case PrecisionMilliseconds:
+		return "milliseconds"
+	}
+	return "seconds"
+}
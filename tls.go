@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var mtlsRejections = metrics.Counter("honeylog_mtls_rejections_total", "Requests rejected for not presenting an acceptable client certificate.")
+
+// serverTLSConfig builds the HTTP and gRPC servers' TLS configuration from
+// TLS_CERT_FILE and TLS_KEY_FILE, or returns nil to serve plain HTTP when
+// they aren't set. With TLS_CLIENT_CA_FILE set, clients are asked for a
+// certificate, which requireClientCert checks.
+func serverTLSConfig() (*tls.Config, error) {
+
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, errors.New("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE to be set")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		// certificates are verified once the request is read rather than
+		// during the handshake, so a rejected client gets a 403 explaining why
+		// instead of a bare TLS alert
+		config.ClientAuth = tls.RequestClientCert
+	}
+	return config, nil
+}
+
+// requireClientCert rejects requests whose client certificate doesn't chain
+// to one of the client CAs, or whose common name isn't allowed when a list of
+// allowed names is given.
+func requireClientCert(next http.Handler, cas *x509.CertPool, allowedCNs []string) http.Handler {
+
+	allowed := allowedCNSet(allowedCNs)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyClientCert(r.TLS, cas, allowed); err != nil {
+			mtlsRejections.Inc()
+			writeError(w, http.StatusForbidden, ErrorClientCertRejected, err.Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireClientCertStream is requireClientCert for gRPC streams, which are
+// refused with PermissionDenied.
+func requireClientCertStream(cas *x509.CertPool, allowedCNs []string) grpc.StreamServerInterceptor {
+
+	allowed := allowedCNSet(allowedCNs)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		var state *tls.ConnectionState
+		if p, ok := peer.FromContext(ss.Context()); ok {
+			if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+				state = &tlsInfo.State
+			}
+		}
+		if err := verifyClientCert(state, cas, allowed); err != nil {
+			mtlsRejections.Inc()
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+		return handler(srv, ss)
+	}
+}
+
+func allowedCNSet(allowedCNs []string) map[string]bool {
+	allowed := make(map[string]bool, len(allowedCNs))
+	for _, cn := range allowedCNs {
+		allowed[cn] = true
+	}
+	return allowed
+}
+
+func verifyClientCert(state *tls.ConnectionState, cas *x509.CertPool, allowed map[string]bool) error {
+
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return errors.New("a client certificate is required")
+	}
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         cas,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("client certificate not trusted: %v", err)
+	}
+	if len(allowed) > 0 && !allowed[leaf.Subject.CommonName] {
+		return fmt.Errorf("client certificate common name %q is not allowed", leaf.Subject.CommonName)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/honeycombio/libhoney-go"
+)
+
+// libhoneyTransport builds the transport libhoney uses to reach Honeycomb
+// from the LIBHONEY_* and PROXY_AUTH_* settings, or returns nil to keep
+// libhoney's default when none of them are set. Either way the proxy is taken
+// from HTTP_PROXY, HTTPS_PROXY and NO_PROXY unless LIBHONEY_PROXY_URL is set.
+func libhoneyTransport() (http.RoundTripper, error) {
+
+	timeout := envInt("LIBHONEY_HTTP_TIMEOUT_SECONDS", 0)
+	maxIdle := envInt("LIBHONEY_MAX_IDLE_CONNS", 0)
+	keepAlive := envInt("LIBHONEY_KEEP_ALIVE_SECONDS", 0)
+	proxy := os.Getenv("LIBHONEY_PROXY_URL")
+	proxyUser := os.Getenv("PROXY_AUTH_USER")
+	if timeout <= 0 && maxIdle <= 0 && keepAlive <= 0 && proxy == "" && proxyUser == "" {
+		return nil, nil
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if timeout > 0 {
+		d := time.Duration(timeout) * time.Second
+		dialer.Timeout = d
+		transport.TLSHandshakeTimeout = d
+		transport.ResponseHeaderTimeout = d
+	}
+	if maxIdle > 0 {
+		transport.MaxIdleConns = maxIdle
+		transport.MaxIdleConnsPerHost = maxIdle
+	}
+	if keepAlive > 0 {
+		dialer.KeepAlive = time.Duration(keepAlive) * time.Second
+	}
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid LIBHONEY_PROXY_URL %q", proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if proxyUser != "" {
+		transport.Proxy = proxyWithAuth(transport.Proxy, url.UserPassword(proxyUser, os.Getenv("PROXY_AUTH_PASSWORD")))
+	}
+	return transport, nil
+}
+
+// proxyWithAuth wraps a proxy function so the proxies it returns carry user
+// as credentials, which the transport sends as a Proxy-Authorization header.
+// Credentials already given in a proxy URL take precedence.
+func proxyWithAuth(proxy func(*http.Request) (*url.URL, error), user *url.Userinfo) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if err != nil || u == nil || u.User != nil {
+			return u, err
+		}
+		withAuth := *u
+		withAuth.User = user
+		return &withAuth, nil
+	}
+}
+
+const (
+	DefaultLibhoneyInitTimeoutSeconds  = 10
+	DefaultLibhoneyFlushTimeoutSeconds = 30
+)
+
+// initLibhoney initializes libhoney, giving up after timeout.
+func initLibhoney(config libhoney.Config, timeout time.Duration) error {
+
+	var err error
+	if !runWithTimeout(timeout, func() { err = libhoney.Init(config) }) {
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+	return err
+}
+
+// closeLibhoney sends any events libhoney still holds and stops it, giving up
+// after timeout. It reports whether it finished in time; if it didn't, the
+// events still held are lost when the process exits.
+func closeLibhoney(timeout time.Duration) bool {
+	return runWithTimeout(timeout, libhoney.Close)
+}
+
+// runWithTimeout runs fn, waiting at most timeout for it to return. fn keeps
+// running in the background if it takes longer. It reports whether fn
+// returned in time.
+func runWithTimeout(timeout time.Duration, fn func()) bool {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// applyLibhoneyBatching sets how libhoney batches events from the
+// LIBHONEY_* batching settings, leaving libhoney's defaults for those not set
+// or not positive.
+//
+// Larger batches and a longer send frequency mean fewer requests to Honeycomb
+// but more latency, and more events lost if the process dies. More concurrent
+// batches help keep up with high volumes over slow links, at the cost of more
+// connections. Pending work capacity is how many events may wait for a batch:
+// once it is full libhoney drops events without telling anyone, so raise it
+// for bursty, high-throughput deployments rather than lowering it.
+func applyLibhoneyBatching(config *libhoney.Config) {
+
+	if n := envInt("LIBHONEY_MAX_BATCH_SIZE", 0); n > 0 {
+		config.MaxBatchSize = uint(n)
+	}
+	if ms := envInt("LIBHONEY_SEND_FREQUENCY_MS", 0); ms > 0 {
+		config.SendFrequency = time.Duration(ms) * time.Millisecond
+	}
+	if n := envInt("LIBHONEY_MAX_CONCURRENT_BATCHES", 0); n > 0 {
+		config.MaxConcurrentBatches = uint(n)
+	}
+	// LIBHONEY_PendingWorkCapacity is the name this was first asked for
+	// under, and is still accepted
+	n := envInt("LIBHONEY_PENDING_WORK_CAPACITY", 0)
+	if n <= 0 {
+		n = envInt("LIBHONEY_PendingWorkCapacity", 0)
+	}
+	if n > 0 {
+		config.PendingWorkCapacity = uint(n)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const DefaultBatchUploadMaxBytes = 1 << 30
+
+// BatchUploadProgressBytes is how often progress through an uploaded file is
+// logged.
+const BatchUploadProgressBytes = 16 << 20
+
+var batchUploadMaxBytes int64 = DefaultBatchUploadMaxBytes
+
+// batchUploadSummary is the response to a batch upload.
+type batchUploadSummary struct {
+	Processed int `json:"processed"`
+	Sent      int `json:"sent"`
+	Errors    int `json:"errors"`
+}
+
+func (s batchUploadSummary) Text() string {
+	return fmt.Sprintf("Processed: %d, Sent: %d, Errors: %d", s.Processed, s.Sent, s.Errors)
+}
+
+// readBatchUpload accepts a file of events, gzipped or not, as the "file"
+// field of a multipart form. The upload is saved to a temp file before it is
+// processed, and the response waits for processing to finish so it can
+// report what happened to the file.
+func readBatchUpload(w http.ResponseWriter, r *http.Request) {
+
+	defer trackInFlight()()
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, "use POST")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, batchUploadMaxBytes)
+	w.Header().Set("X-Request-ID", requestID(r))
+	in := newIngest(r)
+
+	tmp, name, size, err := saveBatchUpload(r)
+	if tmp != nil {
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+	}
+	if err != nil {
+		in.logf("batch upload error %v\n", err)
+		// net/http has no typed error for this before Go 1.19
+		if strings.Contains(err.Error(), "request body too large") {
+			writeError(w, http.StatusRequestEntityTooLarge, ErrorBodyTooLarge, fmt.Sprintf("upload exceeds %d bytes", batchUploadMaxBytes))
+			return
+		}
+		writeError(w, http.StatusBadRequest, ErrorInvalidRequest, err.Error())
+		return
+	}
+	in.logf("Received batch upload %s, %d bytes\n", name, size)
+
+	progress := &progressReader{r: tmp, name: name, size: size, logf: in.logf}
+	br := bufio.NewReader(progress)
+	var body io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			in.logf("batch upload error %v\n", err)
+			writeError(w, http.StatusBadRequest, ErrorBadContentEncoding, err.Error())
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	readInput(in, body, inputFormat)
+	in.finish()
+
+	writeResponse(w, http.StatusOK, batchUploadSummary{
+		Processed: in.total,
+		Sent:      in.success,
+		Errors:    in.parseErrors + in.sendErrors,
+	}, r)
+}
+
+// saveBatchUpload copies the file field of a multipart upload to a temp file,
+// returning it rewound along with the uploaded file name and size.
+func saveBatchUpload(r *http.Request) (*os.File, string, int64, error) {
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, "", 0, errors.New("missing file field")
+		}
+		if err != nil {
+			return nil, "", 0, err
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		tmp, err := os.CreateTemp("", "honeylog-upload-*")
+		if err != nil {
+			return nil, "", 0, err
+		}
+		size, err := io.Copy(tmp, part)
+		if err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		return tmp, part.FileName(), size, err
+	}
+}
+
+// progressReader logs how far through an uploaded file processing has got.
+type progressReader struct {
+	r      io.Reader
+	name   string
+	size   int64
+	read   int64
+	logged int64
+	logf   func(format string, args ...interface{})
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.read-p.logged >= BatchUploadProgressBytes && p.size > 0 {
+		p.logged = p.read
+		p.logf("Batch upload %s: %d%% processed\n", p.name, p.read*100/p.size)
+	}
+	return n, err
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const UpstreamTimeout = 10 * time.Second
+
+// PresampledHeader marks a batch forwarded by another honeylog. Its events
+// carry the sampling decision already made for them, which the receiving
+// honeylog keeps rather than sampling them again.
+const PresampledHeader = "X-Honeylog-Presampled"
+
+const (
+	DefaultUpstreamMaxRetries     = 3
+	DefaultUpstreamRetryBaseMS    = 100
+	DefaultUpstreamRetryMaxMS     = 5000
+	DefaultUpstreamRetryQueueSize = 100
+)
+
+var upstream *upstreamForwarder
+
+var (
+	upstreamRetries = metrics.Counter("honeylog_upstream_retries_total", "Upstream forward attempts that were retries.")
+	upstreamDropped = metrics.Counter("honeylog_upstream_dropped_total", "Events dropped after every upstream forward attempt failed.")
+)
+
+// keptEvent is an event that survived sampling, along with the sampling
+// decision that was made for it.
+type keptEvent struct {
+	data      map[string]interface{}
+	rate      int
+	key       string
+	count     int
+	timestamp time.Time
+	dataset   string
+}
+
+// upstreamForwarder posts kept events to another honeylog instance instead of
+// sending them to Honeycomb directly.
+type upstreamForwarder struct {
+	url      string
+	client   *http.Client
+	fallback bool
+
+	maxRetries int
+	retryBase  time.Duration
+	retryMax   time.Duration
+	retries    chan upstreamRetry
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// upstreamRetry is a batch waiting to be sent upstream again.
+type upstreamRetry struct {
+	body   []byte
+	events []keptEvent
+}
+
+// newUpstreamForwarder configures forwarding from the environment. It returns
+// nil when UPSTREAM_URL is not set.
+func newUpstreamForwarder() (*upstreamForwarder, error) {
+
+	rawURL := os.Getenv("UPSTREAM_URL")
+	if rawURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported upstream scheme %q", u.Scheme)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if envBool("UPSTREAM_SKIP_TLS_VERIFY") {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	f := &upstreamForwarder{
+		url:        rawURL,
+		client:     &http.Client{Timeout: UpstreamTimeout, Transport: transport},
+		fallback:   envBool("UPSTREAM_FALLBACK"),
+		maxRetries: envInt("UPSTREAM_MAX_RETRIES", DefaultUpstreamMaxRetries),
+		retryBase:  time.Duration(envInt("UPSTREAM_RETRY_BASE_MS", DefaultUpstreamRetryBaseMS)) * time.Millisecond,
+		retryMax:   time.Duration(envInt("UPSTREAM_RETRY_MAX_MS", DefaultUpstreamRetryMaxMS)) * time.Millisecond,
+	}
+	if f.maxRetries > 0 {
+		size := envInt("UPSTREAM_RETRY_QUEUE_SIZE", DefaultUpstreamRetryQueueSize)
+		if size <= 0 {
+			size = DefaultUpstreamRetryQueueSize
+		}
+		f.retries = make(chan upstreamRetry, size)
+		f.stop = make(chan struct{})
+		f.done = make(chan struct{})
+		go f.retryLoop()
+	}
+	return f, nil
+}
+
+// forward sends a batch of kept events upstream as newline delimited JSON, the
+// same format readNewData accepts. The local sampling decision travels with
+// each event so it is not lost along the way. If the upstream can't take the
+// batch and retries are enabled, it is queued to be retried in the background
+// and counted as handed off.
+func (u *upstreamForwarder) forward(events []keptEvent) error {
+
+	body, err := encodeKeptEvents(events)
+	if err != nil {
+		return err
+	}
+	err = u.post(body, 0)
+	if err == nil || u.retries == nil {
+		return err
+	}
+
+	select {
+	case u.retries <- upstreamRetry{body: body, events: events}:
+		fmt.Printf("upstream forward error %v, retrying %d events\n", err, len(events))
+		return nil
+	default:
+		return err
+	}
+}
+
+// encodeKeptEvents renders events as the newline delimited JSON body that is
+// posted upstream.
+func encodeKeptEvents(events []keptEvent) ([]byte, error) {
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range events {
+		line := make(map[string]interface{}, len(e.data)+2)
+		for k, v := range e.data {
+			line[k] = v
+		}
+		line[metaField("samplekey")] = e.key
+		line[metaField("samplerate")] = e.rate
+		if err := enc.Encode(line); err != nil {
+			return nil, err
+		}
+	}
+	return body.Bytes(), nil
+}
+
+// edgeDecision is the sampling decision a forwarding honeylog made for an
+// event.
+type edgeDecision struct {
+	rate int
+	key  string
+}
+
+// takeEdgeDecision removes the sample rate and key a forwarding honeylog
+// added to an event, returning nil if the event has no usable rate.
+func takeEdgeDecision(data map[string]interface{}) *edgeDecision {
+
+	rateField, keyField := metaField("samplerate"), metaField("samplekey")
+	rate, ok := numericValue(data[rateField])
+	if !ok || rate < 1 || rate > math.MaxInt32 {
+		return nil
+	}
+	edge := &edgeDecision{rate: int(rate)}
+	if key, ok := data[keyField].(string); ok {
+		edge.key = key
+	}
+	delete(data, rateField)
+	delete(data, keyField)
+	return edge
+}
+
+// post sends an encoded batch upstream. Retries carry an X-Retry-Count header
+// so the upstream can tell them apart from first attempts.
+func (u *upstreamForwarder) post(body []byte, retry int) error {
+
+	req, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set(PresampledHeader, "true")
+	if retry > 0 {
+		req.Header.Set("X-Retry-Count", strconv.Itoa(retry))
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("upstream responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// retryLoop works through queued batches one at a time, backing off between
+// attempts. Once stopped, each remaining batch gets one last attempt without
+// waiting.
+func (u *upstreamForwarder) retryLoop() {
+	defer close(u.done)
+	rng := newRand()
+	for {
+		select {
+		case r := <-u.retries:
+			u.retry(r, rng)
+		case <-u.stop:
+			for {
+				select {
+				case r := <-u.retries:
+					u.retry(r, rng)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (u *upstreamForwarder) retry(r upstreamRetry, rng *rand.Rand) {
+
+	var err error
+	for attempt := 1; attempt <= u.maxRetries; attempt++ {
+		select {
+		case <-time.After(u.retryDelay(attempt-1, rng)):
+		case <-u.stop:
+		}
+		upstreamRetries.Inc()
+		if err = u.post(r.body, attempt); err == nil {
+			return
+		}
+		select {
+		case <-u.stop:
+			attempt = u.maxRetries
+		default:
+		}
+	}
+
+	fmt.Printf("upstream forward error %v, giving up on %d events after %d retries\n", err, len(r.events), u.maxRetries)
+	if u.fallback {
+		sendFallback(r.events)
+		return
+	}
+	upstreamDropped.Add(int64(len(r.events)))
+	sendErrors.Add(int64(len(r.events)))
+	errorRate.record(0, int64(len(r.events)))
+}
+
+// retryDelay returns how long to wait before a retry: the base delay doubled
+// for each earlier retry, plus up to the base delay again of jitter, capped at
+// the maximum delay.
+func (u *upstreamForwarder) retryDelay(attempt int, rng *rand.Rand) time.Duration {
+
+	if u.retryBase <= 0 {
+		return 0
+	}
+	delay := u.retryMax
+	if attempt < 32 {
+		if d := u.retryBase << uint(attempt); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	delay += time.Duration(rng.Int63n(int64(u.retryBase)))
+	if delay > u.retryMax {
+		delay = u.retryMax
+	}
+	return delay
+}
+
+// Stop gives any batches waiting to be retried a final attempt and stops the
+// background retrier.
+func (u *upstreamForwarder) Stop() {
+	if u.retries == nil {
+		return
+	}
+	close(u.stop)
+	<-u.done
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPresampledEventsKeepEdgeRate(t *testing.T) {
+
+	useTestSampler(t, 1000, "service")
+	sender := mockLibhoney(t)
+
+	body, err := encodeKeptEvents([]keptEvent{
+		{data: map[string]interface{}{"service": "a"}, rate: 20, key: "a"},
+		{data: map[string]interface{}{"service": "b"}, rate: 7, key: "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := newHeaderIngest(func(string) []string { return nil })
+	in.presampled = true
+	readJSONLines(in, bytes.NewReader(body))
+	in.finish()
+
+	events := sender.Events()
+	if len(events) != 2 {
+		t.Fatalf("sent %d events, want both presampled events", len(events))
+	}
+	for i, want := range []struct {
+		rate uint
+		key  string
+	}{{20, "a"}, {7, "b"}} {
+		ev := events[i]
+		if ev.SampleRate != want.rate {
+			t.Errorf("event %d sample rate = %d, want the edge's %d", i, ev.SampleRate, want.rate)
+		}
+		if ev.Data[metaField("samplekey")] != want.key {
+			t.Errorf("event %d sample key = %v, want %s", i, ev.Data[metaField("samplekey")], want.key)
+		}
+		if _, ok := ev.Data[metaField("samplerate")]; ok {
+			t.Errorf("event %d still has the forwarded %s field", i, metaField("samplerate"))
+		}
+	}
+}
+
+func TestTakeEdgeDecisionIgnoresBadRates(t *testing.T) {
+
+	for _, rate := range []interface{}{nil, "20", float64(0), float64(-3)} {
+		data := map[string]interface{}{metaField("samplerate"): rate}
+		if edge := takeEdgeDecision(data); edge != nil {
+			t.Errorf("rate %#v gave decision %+v", rate, edge)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/honeycombio/urlshaper"
+	"gopkg.in/yaml.v3"
+)
+
+// urlShapers holds the URL field parsers configured at startup.
+var urlShapers *urlShaperSet
+
+// urlQuerySeparator is ampersand, semicolon or auto, and controls which
+// characters separate query parameters in URL fields.
+var urlQuerySeparator = "ampersand"
+
+// urlStripFragment removes any #fragment from URL fields before they are
+// shaped, so browser URLs shape the same as the requests they made.
+// urlPreserveFragment keeps the removed fragment in a field of its own.
+var (
+	urlStripFragment    = true
+	urlPreserveFragment bool
+)
+
+// urlShaperOptions configures the parser for a single URL field.
+type urlShaperOptions struct {
+	// Patterns are path patterns such as /users/:id used to extract path
+	// fields and build the path shape.
+	Patterns []string `json:"patterns" yaml:"patterns"`
+}
+
+// urlShaperSet holds a parser for each URL field, built once at startup.
+// Fields may be glob patterns such as upstream_url_*, which are listed in
+// wildcards in the order they were configured. Fields without options of
+// their own share a single parser with default options.
+type urlShaperSet struct {
+	fields    map[string]*urlshaper.Parser
+	wildcards []string
+	fallback  *urlshaper.Parser
+}
+
+// loadURLShaperOptions reads per field URL shaper options from a YAML file at
+// path if it is set, and otherwise from rawOptions, a JSON object keyed by
+// field name.
+func loadURLShaperOptions(path, rawOptions string) (map[string]urlShaperOptions, error) {
+
+	options := map[string]urlShaperOptions{}
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(raw, &options); err != nil {
+			return nil, fmt.Errorf("invalid URL shaper config file: %v", err)
+		}
+		return options, nil
+	}
+	if rawOptions != "" {
+		if err := json.Unmarshal([]byte(rawOptions), &options); err != nil {
+			return nil, fmt.Errorf("invalid URL shaper options: %v", err)
+		}
+	}
+	return options, nil
+}
+
+// buildURLShapers creates the parsers for the URL fields. Every field given
+// options is a URL field, whether or not it is listed in fields.
+func buildURLShapers(fields []string, options map[string]urlShaperOptions) (*urlShaperSet, error) {
+
+	set := &urlShaperSet{
+		fields:   make(map[string]*urlshaper.Parser, len(fields)+len(options)),
+		fallback: &urlshaper.Parser{},
+	}
+	extra := make([]string, 0, len(options))
+	for f := range options {
+		extra = append(extra, f)
+	}
+	sort.Strings(extra)
+	fields = append(fields, extra...)
+	for _, f := range fields {
+		if f == "" {
+			continue
+		}
+		if _, ok := set.fields[f]; ok {
+			continue
+		}
+		if strings.ContainsAny(f, "*?[") {
+			if _, err := path.Match(f, ""); err != nil {
+				return nil, fmt.Errorf("invalid URL field pattern %q: %v", f, err)
+			}
+			set.wildcards = append(set.wildcards, f)
+		}
+
+		opts, ok := options[f]
+		if !ok {
+			set.fields[f] = set.fallback
+			continue
+		}
+		shaper := &urlshaper.Parser{}
+		for _, pat := range opts.Patterns {
+			p := &urlshaper.Pattern{Pat: pat}
+			if err := p.Compile(); err != nil {
+				return nil, fmt.Errorf("invalid URL pattern %q for field %s: %v", pat, f, err)
+			}
+			shaper.Patterns = append(shaper.Patterns, p)
+		}
+		set.fields[f] = shaper
+	}
+	return set, nil
+}
+
+// forField returns the parser for a field, or nil if it isn't a URL field. An
+// exact field name takes precedence over any matching pattern.
+func (s *urlShaperSet) forField(field string) *urlshaper.Parser {
+
+	if s == nil {
+		return nil
+	}
+	if shaper, ok := s.fields[field]; ok {
+		return shaper
+	}
+	for _, pattern := range s.wildcards {
+		if ok, _ := path.Match(pattern, field); ok {
+			return s.fields[pattern]
+		}
+	}
+	return nil
+}
+
+// shapeURLField parses the URL in field k and adds its components as fields.
+// Values that don't parse as URLs are left alone. An error is returned if a
+// component collides with an existing field under the error collision policy.
+func shapeURLField(data map[string]interface{}, k string, shaper *urlshaper.Parser) error {
+
+	rawURL := fmt.Sprintf("%v", data[k])
+	var fragment string
+	var hasFragment bool
+	if urlStripFragment {
+		rawURL, fragment, hasFragment = strings.Cut(rawURL, "#")
+	}
+	res, err := parseURL(shaper, rawURL)
+	if err != nil {
+		return nil
+	}
+	// named by suffix, cased to match the input field names
+	fields := map[string]interface{}{
+		".path":       res.Path,
+		".pathShape":  res.PathShape,
+		".query":      res.Query,
+		".queryShape": res.QueryShape,
+		".uri":        res.URI,
+	}
+	for pk, pv := range res.PathFields {
+		fields[".pathFields."+pk] = strings.Join(pv, ",")
+	}
+	for qk, qv := range res.QueryFields {
+		fields[".queryFields."+qk] = strings.Join(qv, ",")
+	}
+	if hasFragment && urlPreserveFragment {
+		fields[".fragment"] = fragment
+	}
+	for suffix, fv := range fields {
+		if _, err := injectField(data, k+inputFieldName(suffix), fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseURL shapes rawURL, first treating semicolons in the query as parameter
+// separators if configured to. In auto mode both readings are tried and the
+// one yielding more query parameters wins. The query and URI of the result are
+// always reported as they were received.
+func parseURL(shaper *urlshaper.Parser, rawURL string) (*urlshaper.Result, error) {
+
+	if urlQuerySeparator == "ampersand" {
+		return shaper.Parse(rawURL)
+	}
+
+	i := strings.IndexByte(rawURL, '?')
+	if i < 0 || !strings.Contains(rawURL[i:], ";") {
+		return shaper.Parse(rawURL)
+	}
+	query := rawURL[i+1:]
+	if j := strings.IndexByte(query, '#'); j >= 0 {
+		query = query[:j]
+	}
+	rewritten := rawURL[:i+1] + strings.ReplaceAll(rawURL[i+1:], ";", "&")
+
+	res, err := shaper.Parse(rewritten)
+	if urlQuerySeparator == "auto" {
+		orig, origErr := shaper.Parse(rawURL)
+		if err != nil || (origErr == nil && len(orig.QueryFields) >= len(res.QueryFields)) {
+			return orig, origErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Query = query
+	res.URI = rawURL
+	return res, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/honeycombio/urlshaper"
+)
+
+func TestShapeURLFieldFragment(t *testing.T) {
+
+	defer func(strip, preserve bool) {
+		urlStripFragment, urlPreserveFragment = strip, preserve
+	}(urlStripFragment, urlPreserveFragment)
+
+	set, err := buildURLShapers(nil, map[string]urlShaperOptions{
+		"url": {Patterns: []string{"/users/:id"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shape := func(rawURL string) map[string]interface{} {
+		data := map[string]interface{}{"url": rawURL}
+		if err := shapeURLField(data, "url", set.forField("url")); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	const withFragment = "/users/42?tab=posts#comments"
+	const without = "/users/42?tab=posts"
+
+	tests := []struct {
+		name         string
+		strip        bool
+		preserve     bool
+		wantURI      string
+		wantFragment interface{}
+	}{
+		{"stripped", true, false, without, nil},
+		{"stripped and preserved", true, true, without, "comments"},
+		{"kept in the URL", false, false, withFragment, nil},
+		{"preserve without strip", false, true, withFragment, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urlStripFragment, urlPreserveFragment = tt.strip, tt.preserve
+			got, plain := shape(withFragment), shape(without)
+
+			if tt.strip {
+				for _, suffix := range []string{".path", ".pathShape", ".query", ".queryShape", ".queryFields.tab", ".pathFields.id"} {
+					if got["url"+suffix] != plain["url"+suffix] {
+						t.Errorf("url%s = %v, want %v as without the fragment", suffix, got["url"+suffix], plain["url"+suffix])
+					}
+				}
+			}
+			if got["url.pathShape"] != "/users/:id" {
+				t.Errorf("url.pathShape = %v, want /users/:id", got["url.pathShape"])
+			}
+			if got["url.uri"] != tt.wantURI {
+				t.Errorf("url.uri = %v, want %s", got["url.uri"], tt.wantURI)
+			}
+			if got["url.fragment"] != tt.wantFragment {
+				t.Errorf("url.fragment = %v, want %v", got["url.fragment"], tt.wantFragment)
+			}
+			if got["url"] != withFragment {
+				t.Errorf("url = %v, the original field should be left alone", got["url"])
+			}
+		})
+	}
+}
+
+func TestShapeURLFieldEmptyFragment(t *testing.T) {
+
+	defer func(strip, preserve bool) {
+		urlStripFragment, urlPreserveFragment = strip, preserve
+	}(urlStripFragment, urlPreserveFragment)
+	urlStripFragment, urlPreserveFragment = true, true
+
+	data := map[string]interface{}{"url": "/checkout#"}
+	if err := shapeURLField(data, "url", &urlshaper.Parser{}); err != nil {
+		t.Fatal(err)
+	}
+	if data["url.uri"] != "/checkout" {
+		t.Errorf("url.uri = %v, want /checkout", data["url.uri"])
+	}
+	if v, ok := data["url.fragment"]; !ok || v != "" {
+		t.Errorf("url.fragment = %v (present %v), want an empty fragment", v, ok)
+	}
+}
+
+var benchmarkURLOptions = map[string]urlShaperOptions{
+	"url": {Patterns: []string{"/users/:id", "/users/:id/posts/:post", "/orgs/:org/teams/:team"}},
+}
+
+// benchmarkURLEvents returns 10k events with distinct URLs.
+func benchmarkURLEvents() []string {
+
+	urls := make([]string, 10000)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("/users/%d/posts/%d?tab=comments&page=%d", i, i%97, i%10)
+	}
+	return urls
+}
+
+func benchmarkShapeURLs(b *testing.B, shaperFor func() *urlshaper.Parser) {
+
+	urls := benchmarkURLEvents()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, u := range urls {
+			data := map[string]interface{}{"url": u}
+			if err := shapeURLField(data, "url", shaperFor()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// BenchmarkShapeURLsPrebuilt shapes 10k events with shapers built once.
+func BenchmarkShapeURLsPrebuilt(b *testing.B) {
+
+	set, err := buildURLShapers(nil, benchmarkURLOptions)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkShapeURLs(b, func() *urlshaper.Parser { return set.forField("url") })
+}
+
+// BenchmarkShapeURLsPerEvent shapes 10k events, building the shapers and
+// compiling their patterns for every event.
+func BenchmarkShapeURLsPerEvent(b *testing.B) {
+
+	benchmarkShapeURLs(b, func() *urlshaper.Parser {
+		set, err := buildURLShapers(nil, benchmarkURLOptions)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return set.forField("url")
+	})
+}
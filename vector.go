@@ -0,0 +1,13 @@
+package main
+
+import (
+	"net/http"
+)
+
+var vectorCompat bool
+
+// writeVectorAck responds the way Vector's http sink expects when end-to-end
+// acknowledgements are enabled.
+func writeVectorAck(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]bool{"acknowledged": true}, r)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// StreamClientBuffer is how many events a stream client may fall behind by
+// before it is disconnected.
+const StreamClientBuffer = 256
+
+var streamUpgrader = websocket.Upgrader{}
+
+var streams = &streamHub{clients: make(map[*streamClient]struct{})}
+
+// outputWrapMetadata separates honeylog's sampling decision from the event
+// fields in streamed events, instead of adding event.samplekey to them.
+var outputWrapMetadata bool
+
+// streamMetadata describes how honeylog handled a streamed event.
+type streamMetadata struct {
+	SampleRate  int       `json:"sample_rate"`
+	SampleKey   string    `json:"sample_key"`
+	Kept        bool      `json:"kept"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+type wrappedEvent struct {
+	Meta streamMetadata         `json:"meta"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// streamHub fans kept events out to connected /stream WebSocket clients.
+type streamHub struct {
+	lock    sync.Mutex
+	clients map[*streamClient]struct{}
+	count   int64
+}
+
+type streamClient struct {
+	send        chan []byte
+	filterField string
+	filterValue string
+	slow        bool
+}
+
+// Clients returns the number of connected stream clients.
+func (h *streamHub) Clients() int64 {
+	return atomic.LoadInt64(&h.count)
+}
+
+// publish sends an event to every client whose filter it matches. Clients
+// that can't keep up are dropped rather than holding up ingestion.
+func (h *streamHub) publish(data map[string]interface{}, key string, rate int) {
+
+	if h.Clients() == 0 {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var line []byte
+	for c := range h.clients {
+		if c.filterField != "" && fmt.Sprintf("%v", data[c.filterField]) != c.filterValue {
+			continue
+		}
+		if line == nil {
+			var err error
+			line, err = streamLine(data, key, rate)
+			if err != nil {
+				return
+			}
+		}
+		select {
+		case c.send <- line:
+		default:
+			h.removeLocked(c, true)
+		}
+	}
+}
+
+// streamLine renders a kept event as a line of JSON for stream clients.
+func streamLine(data map[string]interface{}, key string, rate int) ([]byte, error) {
+
+	var line []byte
+	var err error
+	if outputWrapMetadata {
+		line, err = json.Marshal(wrappedEvent{
+			Meta: streamMetadata{SampleRate: rate, SampleKey: key, Kept: true, ProcessedAt: time.Now().UTC()},
+			Data: data,
+		})
+	} else {
+		event := make(map[string]interface{}, len(data)+1)
+		for k, v := range data {
+			event[k] = v
+		}
+		event[metaField("samplekey")] = key
+		line, err = json.Marshal(event)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+func (h *streamHub) add(c *streamClient) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.clients[c] = struct{}{}
+	atomic.AddInt64(&h.count, 1)
+}
+
+func (h *streamHub) remove(c *streamClient) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.removeLocked(c, false)
+}
+
+// removeLocked disconnects a client if it is still connected. The lock must
+// be held.
+func (h *streamHub) removeLocked(c *streamClient, slow bool) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	atomic.AddInt64(&h.count, -1)
+	c.slow = slow
+	close(c.send)
+}
+
+// serveStream upgrades the request to a WebSocket and streams kept events to
+// it as NDJSON, optionally filtered with ?filter=field:value.
+func serveStream(w http.ResponseWriter, r *http.Request) {
+
+	c := &streamClient{send: make(chan []byte, StreamClientBuffer)}
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		field, value, ok := strings.Cut(filter, ":")
+		if !ok {
+			writeError(w, http.StatusBadRequest, ErrorInvalidRequest, "filter must be field:value")
+			return
+		}
+		c.filterField = field
+		c.filterValue = value
+	}
+
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("stream upgrade error %v\n", err)
+		return
+	}
+	streams.add(c)
+
+	// we don't expect anything from the client, but have to read to notice
+	// when it goes away
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				streams.remove(c)
+				return
+			}
+		}
+	}()
+
+	for line := range c.send {
+		if err := conn.WriteMessage(websocket.TextMessage, line); err != nil {
+			streams.remove(c)
+			break
+		}
+	}
+
+	streams.lock.Lock()
+	slow := c.slow
+	streams.lock.Unlock()
+	if slow {
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "client too slow")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	}
+	conn.Close()
+}